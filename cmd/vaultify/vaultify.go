@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/spf13/pflag"
@@ -12,10 +13,14 @@ import (
 	"github.com/hashicorp/go-hclog"
 	"github.com/spf13/cobra"
 
+	"github.com/ahilsend/vaultify/pkg/config"
 	"github.com/ahilsend/vaultify/pkg/leases"
 	"github.com/ahilsend/vaultify/pkg/options"
+	"github.com/ahilsend/vaultify/pkg/process"
 	"github.com/ahilsend/vaultify/pkg/run"
+	"github.com/ahilsend/vaultify/pkg/secrets"
 	"github.com/ahilsend/vaultify/pkg/template"
+	"github.com/ahilsend/vaultify/pkg/vault"
 )
 
 var (
@@ -31,6 +36,7 @@ var (
 
 	flags = struct {
 		logLevel              int
+		configFile            string
 		commonOptions         options.CommonOptions
 		commomTemplateOptions options.CommonTemplateOptions
 		templateOptions       template.Options
@@ -50,6 +56,9 @@ var (
 		Short: "Templating without renewing leases.",
 		Args:  cobra.ExactArgs(0),
 		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := loadConfig(cmd); err != nil {
+				return err
+			}
 			flags.templateOptions.CommonOptions = flags.commonOptions
 			flags.templateOptions.CommonTemplateOptions = flags.commomTemplateOptions
 
@@ -72,7 +81,11 @@ var (
 		Short: "Continuously renews all secret leases",
 		Args:  cobra.ExactArgs(0),
 		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := loadConfig(cmd); err != nil {
+				return err
+			}
 			flags.renewLeasesOptions.CommonOptions = flags.commonOptions
+			flags.renewLeasesOptions.CommonTemplateOptions = flags.commomTemplateOptions
 
 			if !flags.renewLeasesOptions.IsValid() {
 				return cmd.Help()
@@ -88,12 +101,21 @@ var (
 	}
 
 	runCmd = &cobra.Command{
-		Use:   "run",
-		Short: "Templates a configuration file, and then continuously renews the secret leases. This is combines `template` and `renew-leases`, and does not require writing the lease information to file.",
-		Args:  cobra.ExactArgs(0),
+		Use:   "run [flags] [-- command [args...]]",
+		Short: "Templates a configuration file, and then continuously renews the secret leases. This is combines `template` and `renew-leases`, and does not require writing the lease information to file. Optionally starts and supervises a command after templating.",
+		Args: func(cmd *cobra.Command, args []string) error {
+			if len(args) > 0 && cmd.ArgsLenAtDash() != 0 {
+				return fmt.Errorf("unexpected arguments %v, the command to run has to be passed after --", args)
+			}
+			return nil
+		},
 		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := loadConfig(cmd); err != nil {
+				return err
+			}
 			flags.runOptions.CommonOptions = flags.commonOptions
 			flags.runOptions.CommonTemplateOptions = flags.commomTemplateOptions
+			flags.runOptions.Command = args
 
 			if !flags.runOptions.IsValid() {
 				return cmd.Help()
@@ -102,6 +124,9 @@ var (
 			logger.SetLevel(logLevel())
 
 			if err := run.Run(logger, &flags.runOptions); err != nil {
+				if exitErr, ok := err.(*process.ExitError); ok {
+					os.Exit(exitErr.Code)
+				}
 				return fmt.Errorf("run failed: %v", err)
 			}
 			return nil
@@ -109,6 +134,104 @@ var (
 	}
 )
 
+// loadConfig applies the configuration file to the flags not set on the
+// command line, and adds its templates.
+func loadConfig(cmd *cobra.Command) error {
+	if flags.configFile == "" {
+		return nil
+	}
+
+	c, err := config.Load(flags.configFile)
+	if err != nil {
+		return err
+	}
+	if err := c.Apply(cmd.Flags()); err != nil {
+		return fmt.Errorf("invalid config file %s: %v", flags.configFile, err)
+	}
+	flags.commomTemplateOptions.Templates = append(flags.commomTemplateOptions.Templates, c.TemplateOptions()...)
+	return nil
+}
+
+// templatesValue is a repeatable flag of template:output pairs.
+type templatesValue struct {
+	templates *[]options.TemplateConfig
+}
+
+func (v *templatesValue) Set(value string) error {
+	template, err := options.ParseTemplateConfig(value)
+	if err != nil {
+		return err
+	}
+	*v.templates = append(*v.templates, template)
+	return nil
+}
+
+func (v *templatesValue) String() string {
+	if v.templates == nil {
+		return ""
+	}
+	var pairs []string
+	for _, template := range *v.templates {
+		pairs = append(pairs, template.TemplatePath+":"+template.OutputPath)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (v *templatesValue) Type() string {
+	return "template:output"
+}
+
+// fileModeValue is a flag of octal file permissions.
+type fileModeValue struct {
+	mode *os.FileMode
+}
+
+func (v *fileModeValue) Set(value string) error {
+	mode, err := options.ParseFileMode(value)
+	if err != nil {
+		return err
+	}
+	*v.mode = mode
+	return nil
+}
+
+func (v *fileModeValue) String() string {
+	if v.mode == nil || *v.mode == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%04o", uint32(*v.mode))
+}
+
+func (v *fileModeValue) Type() string {
+	return "mode"
+}
+
+// idValue is a flag of a user or group, given by name or id.
+type idValue struct {
+	id     **int
+	lookup func(nameOrId string) (int, error)
+}
+
+func (v *idValue) Set(value string) error {
+	id, err := v.lookup(value)
+	if err != nil {
+		return err
+	}
+	*v.id = &id
+	return nil
+}
+
+func (v *idValue) String() string {
+	if v.id == nil || *v.id == nil {
+		return ""
+	}
+	return fmt.Sprint(**v.id)
+}
+
+func (v *idValue) Type() string {
+	return "name|id"
+}
+
 func logLevel() hclog.Level {
 	switch flags.logLevel {
 	case 0:
@@ -129,11 +252,51 @@ func init() {
 		"verbose",
 		"v",
 		"Log level. Defaults to 'error', Set multiple times to increase log level")
+	rootCmd.PersistentFlags().StringVar(
+		&flags.configFile,
+		"config",
+		"",
+		"YAML configuration file. Flags set on the command line take precedence over it")
 	rootCmd.PersistentFlags().StringVar(
 		&flags.commonOptions.VaultAddress,
 		"vault",
 		"",
 		"Vault address. Can be specified via VAULT_ADDR instead")
+	rootCmd.PersistentFlags().StringVar(
+		&flags.commonOptions.Namespace,
+		"namespace",
+		"",
+		"Vault namespace (Vault Enterprise). Can be specified via VAULT_NAMESPACE instead")
+	rootCmd.PersistentFlags().StringVar(
+		&flags.commonOptions.CACert,
+		"ca-cert",
+		"",
+		"PEM encoded CA certificate file to verify the vault server certificate. Can be specified via VAULT_CACERT instead")
+	rootCmd.PersistentFlags().StringVar(
+		&flags.commonOptions.CAPath,
+		"ca-path",
+		"",
+		"Directory of PEM encoded CA certificate files to verify the vault server certificate. Can be specified via VAULT_CAPATH instead")
+	rootCmd.PersistentFlags().StringVar(
+		&flags.commonOptions.ClientCert,
+		"client-cert",
+		"",
+		"PEM encoded client certificate file for TLS authentication. Can be specified via VAULT_CLIENT_CERT instead")
+	rootCmd.PersistentFlags().StringVar(
+		&flags.commonOptions.ClientKey,
+		"client-key",
+		"",
+		"PEM encoded private key file of the client certificate. Can be specified via VAULT_CLIENT_KEY instead")
+	rootCmd.PersistentFlags().StringVar(
+		&flags.commonOptions.TLSServerName,
+		"tls-server-name",
+		"",
+		"Server name to use as SNI host when connecting to vault. Can be specified via VAULT_TLS_SERVER_NAME instead")
+	rootCmd.PersistentFlags().BoolVar(
+		&flags.commonOptions.TLSSkipVerify,
+		"tls-skip-verify",
+		false,
+		"Do not verify the vault server certificate, this is insecure. Can be specified via VAULT_SKIP_VERIFY instead")
 	rootCmd.PersistentFlags().DurationVar(
 		&flags.commonOptions.Timeout,
 		"timeout",
@@ -159,21 +322,54 @@ func init() {
 		rootCmd.PersistentFlags().AddGoFlag(gf)
 	})
 
-	templatingCmds := []*cobra.Command{templateCmd, runCmd}
+	// renew-leases renders the templates again with the rerender expired leases policy
+	templatingCmds := []*cobra.Command{templateCmd, renewLeasesCmd, runCmd}
 	for _, cmd := range templatingCmds {
-		cmd.Flags().StringVar(&flags.commomTemplateOptions.Role, "role", "", "Vault kubernetes role to assume")
+		cmd.Flags().StringVar(&flags.commomTemplateOptions.AuthMethod, "auth-method", vault.AuthMethodKubernetes, "Vault auth method, one of "+strings.Join(vault.AuthMethods, ", "))
+		cmd.Flags().StringVar(&flags.commomTemplateOptions.Role, "role", "", "Vault role to assume, for the kubernetes and jwt auth methods, or the certificate role for the cert auth method")
+		cmd.Flags().StringVar(&flags.commomTemplateOptions.AuthMountPath, "auth-mount-path", "", "Mount path of the auth method, defaults to auth/<auth-method>, e.g. auth/kubernetes")
+		cmd.Flags().StringVar(&flags.commomTemplateOptions.KubernetesTokenPath, "kubernetes-token-path", "", "Service account token for the kubernetes auth method, e.g. a projected token. Defaults to the token mounted into the pod")
+		cmd.Flags().StringVar(&flags.commomTemplateOptions.KubernetesAudience, "kubernetes-audience", "", "Expected audience of the service account token for the kubernetes auth method, only checked by vaultify before logging in")
+		cmd.Flags().StringVar(&flags.commomTemplateOptions.TokenFile, "token-file", "", "File containing the token for the token auth method. VAULT_TOKEN is used if not set")
+		cmd.Flags().StringVar(&flags.commomTemplateOptions.RoleIdFile, "role-id-file", "", "File containing the role id for the approle auth method")
+		cmd.Flags().StringVar(&flags.commomTemplateOptions.SecretIdFile, "secret-id-file", "", "File containing the secret id for the approle auth method")
+		cmd.Flags().StringVar(&flags.commomTemplateOptions.JwtFile, "jwt-file", "", "File containing the JWT for the jwt auth method")
+		cmd.Flags().StringVar(&flags.commomTemplateOptions.Username, "username", "", "Username for the userpass auth method")
+		cmd.Flags().StringVar(&flags.commomTemplateOptions.PasswordFile, "password-file", "", "File containing the password for the userpass auth method")
 		cmd.Flags().StringVar(&flags.commomTemplateOptions.TemplateFileName, "template-file", "", "(DEPRECATED) Template file to render, use template-path instead")
 		cmd.Flags().StringVar(&flags.commomTemplateOptions.OutputPath, "output-file", "", "(DEPRECATED) Output file, use output-path instead")
 		cmd.Flags().StringVar(&flags.commomTemplateOptions.TemplatePath, "template-path", "", "Template path to render file or files from directory")
 		cmd.Flags().StringVar(&flags.commomTemplateOptions.OutputPath, "output-path", "", "Output path")
+		cmd.Flags().Var(&fileModeValue{&flags.commomTemplateOptions.OutputMode}, "output-mode", "Octal mode of the output files, e.g. 0640. Defaults to 0600")
+		cmd.Flags().Var(&idValue{&flags.commomTemplateOptions.OutputUid, options.LookupUid}, "output-owner", "User name or id owning the output files")
+		cmd.Flags().Var(&idValue{&flags.commomTemplateOptions.OutputGid, options.LookupGid}, "output-group", "Group name or id owning the output files")
+		cmd.Flags().BoolVar(&flags.commomTemplateOptions.PreserveMode, "preserve-mode", false, "Use the mode of the template files for the output files, if --output-mode is not set")
+		cmd.Flags().StringSliceVar(&flags.commomTemplateOptions.Include, "include", nil, "Glob patterns of the files of template directories to render, e.g. '*.yaml'. Patterns without a slash match the file name, others the path relative to the template directory")
+		cmd.Flags().StringSliceVar(&flags.commomTemplateOptions.Exclude, "exclude", nil, "Glob patterns of the files and directories of template directories to skip")
+		cmd.Flags().StringVar(&flags.commomTemplateOptions.TemplateSuffix, "template-suffix", "", "Suffix of the template files in template directories, stripped from the output files, e.g. .tmpl")
+		cmd.Flags().BoolVar(&flags.commomTemplateOptions.CopyNonTemplates, "copy-non-templates", false, "Copy files without the --template-suffix verbatim instead of rendering them")
+		cmd.Flags().StringVar(&flags.commomTemplateOptions.LeftDelimiter, "left-delimiter", "<{", "Left delimiter of template actions")
+		cmd.Flags().StringVar(&flags.commomTemplateOptions.RightDelimiter, "right-delimiter", "}>", "Right delimiter of template actions")
+		cmd.Flags().Var(&templatesValue{&flags.commomTemplateOptions.Templates}, "template", "Template path and output path to render, separated by a colon, e.g. templates/app.yaml:/app/config.yaml. Can be repeated")
+		cmd.Flags().StringVar(&flags.commomTemplateOptions.OnChangeCommand, "on-change-command", "", "Shell command to run when an output file changed. The changed files are passed in VAULTIFY_CHANGED_FILES")
+		cmd.Flags().StringVar(&flags.commomTemplateOptions.OnChangeSignal, "on-change-signal", "", "Signal to send to a process when an output file changed, e.g. SIGHUP. Requires --on-change-pid-file or --on-change-process")
+		cmd.Flags().StringVar(&flags.commomTemplateOptions.OnChangePidFile, "on-change-pid-file", "", "Pid file of the process to send the --on-change-signal to")
+		cmd.Flags().StringVar(&flags.commomTemplateOptions.OnChangeProcessName, "on-change-process", "", "Name of the processes to send the --on-change-signal to")
 	}
 
 	templateCmd.Flags().StringVar(&flags.templateOptions.SecretsOutputFileName, "secrets-output-file", "", "Secrets output file")
+	templateCmd.Flags().StringVar(&flags.templateOptions.SecretsKeyFile, "secrets-key-file", "", "File containing a base64 encoded 256 bit key to encrypt the secrets output file with. "+secrets.KeyEnv+" is used if not set")
+	templateCmd.Flags().DurationVar(&flags.templateOptions.SecretsWrapTTL, "secrets-wrap-ttl", 0, "Store the auth token in the secrets output file response wrapped with this TTL, renew-leases has to unwrap it within the TTL. 0 stores the token itself")
 	templateCmd.Flags().StringToStringVar(&flags.commomTemplateOptions.Variables, "var", map[string]string{}, "Variables to use instead of fetching secrets from vault. Does not require vault, this is for testing the templating only.")
 
 	renewLeasesCmd.Flags().StringVar(&flags.renewLeasesOptions.SecretsFileName, "secrets-file", "", "Secrets file")
+	renewLeasesCmd.Flags().StringVar(&flags.renewLeasesOptions.SecretsKeyFile, "secrets-key-file", "", "File containing the base64 encoded 256 bit key the secrets file is encrypted with. "+secrets.KeyEnv+" is used if not set")
+	renewLeasesCmd.Flags().DurationVar(&flags.renewLeasesOptions.SecretsWrapTTL, "secrets-wrap-ttl", 0, "Store the auth token response wrapped with this TTL when rendering the templates again with the rerender expired leases policy")
 	renewLeasesCmd.Flags().StringVar(&flags.renewLeasesOptions.ListenAddress, "listen-address", ":9105", "Listen address for metrics, and the /healthz and /readyz endpoints. --metrics-address is aliased to this flag.")
 	renewLeasesCmd.Flags().StringVar(&flags.renewLeasesOptions.MetricsPath, "metrics-path", "/metrics", "Metrics path")
+	renewLeasesCmd.Flags().StringVar(&flags.renewLeasesOptions.ExpiredLeasesPolicy, "expired-leases-policy", leases.ExpiredLeasesPolicyFail, "What to do when leases in the secrets file expired at startup, one of "+strings.Join(leases.ExpiredLeasesPolicies, ", ")+". rerender renders the templates again, and requires the templating flags")
+	renewLeasesCmd.Flags().DurationVar(&flags.renewLeasesOptions.LeaseExpiryThreshold, "lease-expiry-threshold", time.Minute, "Leases expiring within this duration at startup are reported, and rendered again with the rerender policy")
+	renewLeasesCmd.Flags().BoolVar(&flags.renewLeasesOptions.RevokeOnShutdown, "revoke-on-shutdown", false, "Revoke all secret leases and the auth token obtained by logging in on SIGINT or SIGTERM")
 	renewLeasesCmd.Flags().SetNormalizeFunc(func(f *pflag.FlagSet, name string) pflag.NormalizedName {
 		switch name {
 		case "metrics-address":
@@ -185,6 +381,12 @@ func init() {
 
 	runCmd.Flags().StringVar(&flags.runOptions.MetricsAddress, "metrics-address", ":9105", "Metrics address")
 	runCmd.Flags().StringVar(&flags.runOptions.MetricsPath, "metrics-path", "/metrics", "Metrics path")
+	runCmd.Flags().Float64Var(&flags.runOptions.CertificateRenewFraction, "certificate-renew-fraction", 2.0/3.0, "Fraction of the validity of PKI certificates, after which they are issued again and the templates using them are rendered again")
+	runCmd.Flags().DurationVar(&flags.runOptions.PollInterval, "poll-interval", 0, "Interval to read secrets without a lease, like KV secrets, again and render the templates using them when they changed, 0 disables polling")
+	runCmd.Flags().BoolVar(&flags.runOptions.RevokeOnShutdown, "revoke-on-shutdown", false, "Revoke all secret leases and the auth token obtained by logging in on SIGINT or SIGTERM, or when the command exited")
+	runCmd.Flags().BoolVar(&flags.runOptions.DeleteOutputsOnShutdown, "delete-outputs-on-shutdown", false, "Remove all rendered output files on SIGINT or SIGTERM, or when the command exited")
+	runCmd.Flags().BoolVar(&flags.runOptions.RestartOnRender, "restart-on-render", false, "Restart the command when templates are rendered again")
+	runCmd.Flags().StringVar(&flags.runOptions.ReloadSignal, "reload-signal", "", "Signal to send to the command when templates are rendered again, e.g. SIGHUP")
 
 	rootCmd.AddCommand(templateCmd)
 	rootCmd.AddCommand(renewLeasesCmd)
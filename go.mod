@@ -97,6 +97,7 @@ require (
 	gopkg.in/ini.v1 v1.42.0 // indirect
 	gopkg.in/ory-am/dockertest.v2 v2.2.3 // indirect
 	gopkg.in/square/go-jose.v2 v2.3.0 // indirect
+	gopkg.in/yaml.v2 v2.4.0
 	k8s.io/api v0.0.0-20190313115550-3c12c96769cc // indirect
 	k8s.io/apimachinery v0.0.0-20190323104403-03ac7a9ade42 // indirect
 	k8s.io/klog v0.2.0 // indirect
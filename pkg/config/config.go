@@ -0,0 +1,446 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v2"
+
+	"github.com/ahilsend/vaultify/pkg/leases"
+	"github.com/ahilsend/vaultify/pkg/options"
+	"github.com/ahilsend/vaultify/pkg/process"
+)
+
+// Config is the content of a configuration file. All settings are optional,
+// flags set on the command line take precedence over them.
+type Config struct {
+	Vault     *VaultConfig     `yaml:"vault"`
+	Auth      *AuthConfig      `yaml:"auth"`
+	Templates []TemplateConfig `yaml:"templates"`
+	Output    *OutputConfig    `yaml:"output"`
+	// Default delimiters of all templates
+	Delimiters *DelimitersConfig `yaml:"delimiters"`
+	OnChange   *HookConfig       `yaml:"on_change"`
+	Secrets    *SecretsConfig    `yaml:"secrets"`
+	Metrics    *MetricsConfig    `yaml:"metrics"`
+	Renewal    *RenewalConfig    `yaml:"renewal"`
+}
+
+// VaultConfig configures the vault connection.
+type VaultConfig struct {
+	Address        *string `yaml:"address"`
+	Namespace      *string `yaml:"namespace"`
+	CACert         *string `yaml:"ca_cert"`
+	CAPath         *string `yaml:"ca_path"`
+	ClientCert     *string `yaml:"client_cert"`
+	ClientKey      *string `yaml:"client_key"`
+	TLSServerName  *string `yaml:"tls_server_name"`
+	TLSSkipVerify  *bool   `yaml:"tls_skip_verify"`
+	Timeout        *string `yaml:"timeout"`
+	MaxRetries     *int    `yaml:"max_retries"`
+	RateLimit      *string `yaml:"rate_limit"`
+	RateLimitBurst *int    `yaml:"rate_limit_burst"`
+}
+
+// AuthConfig configures how to log in to vault.
+type AuthConfig struct {
+	Method              *string `yaml:"method"`
+	MountPath           *string `yaml:"mount_path"`
+	Role                *string `yaml:"role"`
+	KubernetesTokenPath *string `yaml:"kubernetes_token_path"`
+	KubernetesAudience  *string `yaml:"kubernetes_audience"`
+	TokenFile           *string `yaml:"token_file"`
+	RoleIdFile          *string `yaml:"role_id_file"`
+	SecretIdFile        *string `yaml:"secret_id_file"`
+	JwtFile             *string `yaml:"jwt_file"`
+	Username            *string `yaml:"username"`
+	PasswordFile        *string `yaml:"password_file"`
+}
+
+// TemplateConfig is a template file or directory rendered to a destination.
+type TemplateConfig struct {
+	Source      string `yaml:"source"`
+	Destination string `yaml:"destination"`
+	// Octal mode of the output files, e.g. "0640"
+	Mode string `yaml:"mode"`
+	// User and group name or id owning the output files
+	Owner string `yaml:"owner"`
+	Group string `yaml:"group"`
+	// Use the mode of the template files, if mode is not set
+	PreserveMode bool `yaml:"preserve_mode"`
+	// File filtering of template directories
+	Include          []string          `yaml:"include"`
+	Exclude          []string          `yaml:"exclude"`
+	TemplateSuffix   string            `yaml:"template_suffix"`
+	CopyNonTemplates bool              `yaml:"copy_non_templates"`
+	Delimiters       *DelimitersConfig `yaml:"delimiters"`
+	OnChange         *HookConfig       `yaml:"on_change"`
+}
+
+// DelimitersConfig configures the action delimiters of templates.
+type DelimitersConfig struct {
+	Left  *string `yaml:"left"`
+	Right *string `yaml:"right"`
+}
+
+// OutputConfig configures the default permissions of the output files.
+type OutputConfig struct {
+	Mode         *string `yaml:"mode"`
+	Owner        *string `yaml:"owner"`
+	Group        *string `yaml:"group"`
+	PreserveMode *bool   `yaml:"preserve_mode"`
+}
+
+// HookConfig configures what to run when output files changed.
+type HookConfig struct {
+	Command *string `yaml:"command"`
+	Signal  *string `yaml:"signal"`
+	PidFile *string `yaml:"pid_file"`
+	Process *string `yaml:"process"`
+}
+
+// SecretsConfig configures the secrets file of template and renew-leases.
+type SecretsConfig struct {
+	File    *string `yaml:"file"`
+	KeyFile *string `yaml:"key_file"`
+	WrapTTL *string `yaml:"wrap_ttl"`
+}
+
+// MetricsConfig configures where metrics are exposed.
+type MetricsConfig struct {
+	Address *string `yaml:"address"`
+	Path    *string `yaml:"path"`
+}
+
+// RenewalConfig configures the renewal of leases by run and renew-leases.
+type RenewalConfig struct {
+	CertificateRenewFraction *float64 `yaml:"certificate_renew_fraction"`
+	PollInterval             *string  `yaml:"poll_interval"`
+	RestartOnRender          *bool    `yaml:"restart_on_render"`
+	ReloadSignal             *string  `yaml:"reload_signal"`
+	RevokeOnShutdown         *bool    `yaml:"revoke_on_shutdown"`
+	DeleteOutputsOnShutdown  *bool    `yaml:"delete_outputs_on_shutdown"`
+	ExpiredLeasesPolicy      *string  `yaml:"expired_leases_policy"`
+	LeaseExpiryThreshold     *string  `yaml:"lease_expiry_threshold"`
+}
+
+// setting is a config file setting, applied to the flags it corresponds to.
+type setting struct {
+	// Name of the setting in the config file, for error messages
+	name  string
+	flags []string
+	// Pointer to the value, nil if not set
+	value interface{}
+}
+
+// Load reads a configuration file. Unknown settings are rejected.
+func Load(fileName string) (*Config, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	var config Config
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %v", fileName, err)
+	}
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %v", fileName, err)
+	}
+	return &config, nil
+}
+
+func (c *Config) validate() error {
+	for i, template := range c.Templates {
+		if template.Source == "" {
+			return fmt.Errorf("templates[%d]: source is required", i)
+		}
+		if template.Destination == "" {
+			return fmt.Errorf("templates[%d]: destination is required", i)
+		}
+		if _, err := template.options(); err != nil {
+			return fmt.Errorf("templates[%d]: %v", i, err)
+		}
+	}
+
+	if c.OnChange != nil {
+		if err := c.OnChange.validate(); err != nil {
+			return fmt.Errorf("on_change: %v", err)
+		}
+	}
+	if c.Delimiters != nil {
+		if err := c.Delimiters.validate(); err != nil {
+			return fmt.Errorf("delimiters: %v", err)
+		}
+	}
+	if c.Output != nil && c.Output.Mode != nil {
+		if _, err := options.ParseFileMode(*c.Output.Mode); err != nil {
+			return fmt.Errorf("output.mode: %v", err)
+		}
+	}
+	if c.Renewal != nil {
+		if err := c.Renewal.validate(); err != nil {
+			return fmt.Errorf("renewal.%v", err)
+		}
+	}
+	return nil
+}
+
+func (r *RenewalConfig) validate() error {
+	if r.CertificateRenewFraction != nil && (*r.CertificateRenewFraction <= 0 || *r.CertificateRenewFraction >= 1) {
+		return fmt.Errorf("certificate_renew_fraction: %v is not between 0 and 1", *r.CertificateRenewFraction)
+	}
+	if r.RestartOnRender != nil && *r.RestartOnRender && r.ReloadSignal != nil && *r.ReloadSignal != "" {
+		return fmt.Errorf("reload_signal: can't be used with restart_on_render")
+	}
+	if r.ReloadSignal != nil && *r.ReloadSignal != "" {
+		if _, err := process.ParseSignal(*r.ReloadSignal); err != nil {
+			return fmt.Errorf("reload_signal: %v", err)
+		}
+	}
+	if r.ExpiredLeasesPolicy != nil && !contains(leases.ExpiredLeasesPolicies, *r.ExpiredLeasesPolicy) {
+		return fmt.Errorf("expired_leases_policy: unknown policy '%s', expected one of %s",
+			*r.ExpiredLeasesPolicy, strings.Join(leases.ExpiredLeasesPolicies, ", "))
+	}
+	for name, value := range map[string]*string{
+		"poll_interval":          r.PollInterval,
+		"lease_expiry_threshold": r.LeaseExpiryThreshold,
+	} {
+		if value == nil {
+			continue
+		}
+		if duration, err := time.ParseDuration(*value); err != nil || duration < 0 {
+			return fmt.Errorf("%s: invalid duration '%s'", name, *value)
+		}
+	}
+	return nil
+}
+
+// Apply sets the flags to the values of the config file, unless they are set
+// on the command line. Settings without a flag in flags, e.g. the metrics of
+// the template command, are ignored.
+func (c *Config) Apply(flags *pflag.FlagSet) error {
+	for _, setting := range c.settings() {
+		value := reflect.ValueOf(setting.value)
+		if value.IsNil() {
+			continue
+		}
+		stringValue := fmt.Sprint(value.Elem().Interface())
+
+		for _, name := range setting.flags {
+			flag := flags.Lookup(name)
+			if flag == nil || flag.Changed {
+				continue
+			}
+			if err := flag.Value.Set(stringValue); err != nil {
+				return fmt.Errorf("invalid value '%s' of %s: %v", stringValue, setting.name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// TemplateOptions returns the templates to render.
+func (c *Config) TemplateOptions() []options.TemplateConfig {
+	templates := make([]options.TemplateConfig, 0, len(c.Templates))
+	for _, template := range c.Templates {
+		// validated when loading
+		templateOptions, _ := template.options()
+		templates = append(templates, templateOptions)
+	}
+	return templates
+}
+
+func (t *TemplateConfig) options() (options.TemplateConfig, error) {
+	templateOptions := options.NewTemplateConfig(t.Source, t.Destination)
+
+	if t.Mode != "" {
+		mode, err := options.ParseFileMode(t.Mode)
+		if err != nil {
+			return templateOptions, err
+		}
+		templateOptions.Mode = mode
+	}
+	templateOptions.PreserveMode = t.PreserveMode
+
+	if t.Owner != "" {
+		uid, err := options.LookupUid(t.Owner)
+		if err != nil {
+			return templateOptions, fmt.Errorf("invalid owner: %v", err)
+		}
+		templateOptions.Uid = uid
+	}
+
+	if t.Group != "" {
+		gid, err := options.LookupGid(t.Group)
+		if err != nil {
+			return templateOptions, fmt.Errorf("invalid group: %v", err)
+		}
+		templateOptions.Gid = gid
+	}
+
+	templateOptions.DirectoryOptions = options.DirectoryOptions{
+		Include:          t.Include,
+		Exclude:          t.Exclude,
+		TemplateSuffix:   t.TemplateSuffix,
+		CopyNonTemplates: t.CopyNonTemplates,
+	}
+	if !templateOptions.DirectoryOptions.IsValid() {
+		return templateOptions, fmt.Errorf("invalid include or exclude pattern, or copy_non_templates without template_suffix")
+	}
+
+	if t.Delimiters != nil {
+		if err := t.Delimiters.validate(); err != nil {
+			return templateOptions, fmt.Errorf("delimiters: %v", err)
+		}
+		templateOptions.LeftDelimiter = *t.Delimiters.Left
+		templateOptions.RightDelimiter = *t.Delimiters.Right
+	}
+
+	if t.OnChange != nil {
+		if err := t.OnChange.validate(); err != nil {
+			return templateOptions, fmt.Errorf("on_change: %v", err)
+		}
+		templateOptions.HookOptions = t.OnChange.options()
+	}
+	return templateOptions, nil
+}
+
+func (d *DelimitersConfig) validate() error {
+	if d.Left == nil || d.Right == nil || *d.Left == "" || *d.Right == "" {
+		return fmt.Errorf("left and right are required")
+	}
+	return nil
+}
+
+func (h *HookConfig) validate() error {
+	hookOptions := h.options()
+	if !hookOptions.IsValid() {
+		return fmt.Errorf("signal requires pid_file or process")
+	}
+	if hookOptions.OnChangeSignal != "" {
+		if _, err := process.ParseSignal(hookOptions.OnChangeSignal); err != nil {
+			return fmt.Errorf("signal: %v", err)
+		}
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *HookConfig) options() options.HookOptions {
+	var hookOptions options.HookOptions
+	set := func(target *string, value *string) {
+		if value != nil {
+			*target = *value
+		}
+	}
+	set(&hookOptions.OnChangeCommand, h.Command)
+	set(&hookOptions.OnChangeSignal, h.Signal)
+	set(&hookOptions.OnChangePidFile, h.PidFile)
+	set(&hookOptions.OnChangeProcessName, h.Process)
+	return hookOptions
+}
+
+// settings returns the settings that correspond to flags.
+func (c *Config) settings() []setting {
+	vault := c.Vault
+	if vault == nil {
+		vault = &VaultConfig{}
+	}
+	auth := c.Auth
+	if auth == nil {
+		auth = &AuthConfig{}
+	}
+	onChange := c.OnChange
+	if onChange == nil {
+		onChange = &HookConfig{}
+	}
+	output := c.Output
+	if output == nil {
+		output = &OutputConfig{}
+	}
+	delimiters := c.Delimiters
+	if delimiters == nil {
+		delimiters = &DelimitersConfig{}
+	}
+	secrets := c.Secrets
+	if secrets == nil {
+		secrets = &SecretsConfig{}
+	}
+	metrics := c.Metrics
+	if metrics == nil {
+		metrics = &MetricsConfig{}
+	}
+	renewal := c.Renewal
+	if renewal == nil {
+		renewal = &RenewalConfig{}
+	}
+
+	return []setting{
+		{"vault.address", []string{"vault"}, vault.Address},
+		{"vault.namespace", []string{"namespace"}, vault.Namespace},
+		{"vault.ca_cert", []string{"ca-cert"}, vault.CACert},
+		{"vault.ca_path", []string{"ca-path"}, vault.CAPath},
+		{"vault.client_cert", []string{"client-cert"}, vault.ClientCert},
+		{"vault.client_key", []string{"client-key"}, vault.ClientKey},
+		{"vault.tls_server_name", []string{"tls-server-name"}, vault.TLSServerName},
+		{"vault.tls_skip_verify", []string{"tls-skip-verify"}, vault.TLSSkipVerify},
+		{"vault.timeout", []string{"timeout"}, vault.Timeout},
+		{"vault.max_retries", []string{"max-retries"}, vault.MaxRetries},
+		{"vault.rate_limit", []string{"rate-limit"}, vault.RateLimit},
+		{"vault.rate_limit_burst", []string{"rate-limit-burst"}, vault.RateLimitBurst},
+
+		{"auth.method", []string{"auth-method"}, auth.Method},
+		{"auth.mount_path", []string{"auth-mount-path"}, auth.MountPath},
+		{"auth.role", []string{"role"}, auth.Role},
+		{"auth.kubernetes_token_path", []string{"kubernetes-token-path"}, auth.KubernetesTokenPath},
+		{"auth.kubernetes_audience", []string{"kubernetes-audience"}, auth.KubernetesAudience},
+		{"auth.token_file", []string{"token-file"}, auth.TokenFile},
+		{"auth.role_id_file", []string{"role-id-file"}, auth.RoleIdFile},
+		{"auth.secret_id_file", []string{"secret-id-file"}, auth.SecretIdFile},
+		{"auth.jwt_file", []string{"jwt-file"}, auth.JwtFile},
+		{"auth.username", []string{"username"}, auth.Username},
+		{"auth.password_file", []string{"password-file"}, auth.PasswordFile},
+
+		{"on_change.command", []string{"on-change-command"}, onChange.Command},
+		{"on_change.signal", []string{"on-change-signal"}, onChange.Signal},
+		{"on_change.pid_file", []string{"on-change-pid-file"}, onChange.PidFile},
+		{"on_change.process", []string{"on-change-process"}, onChange.Process},
+
+		{"output.mode", []string{"output-mode"}, output.Mode},
+		{"output.owner", []string{"output-owner"}, output.Owner},
+		{"output.group", []string{"output-group"}, output.Group},
+		{"output.preserve_mode", []string{"preserve-mode"}, output.PreserveMode},
+
+		{"delimiters.left", []string{"left-delimiter"}, delimiters.Left},
+		{"delimiters.right", []string{"right-delimiter"}, delimiters.Right},
+
+		{"secrets.file", []string{"secrets-output-file", "secrets-file"}, secrets.File},
+		{"secrets.key_file", []string{"secrets-key-file"}, secrets.KeyFile},
+		{"secrets.wrap_ttl", []string{"secrets-wrap-ttl"}, secrets.WrapTTL},
+
+		{"metrics.address", []string{"metrics-address"}, metrics.Address},
+		{"metrics.path", []string{"metrics-path"}, metrics.Path},
+
+		{"renewal.certificate_renew_fraction", []string{"certificate-renew-fraction"}, renewal.CertificateRenewFraction},
+		{"renewal.poll_interval", []string{"poll-interval"}, renewal.PollInterval},
+		{"renewal.restart_on_render", []string{"restart-on-render"}, renewal.RestartOnRender},
+		{"renewal.reload_signal", []string{"reload-signal"}, renewal.ReloadSignal},
+		{"renewal.revoke_on_shutdown", []string{"revoke-on-shutdown"}, renewal.RevokeOnShutdown},
+		{"renewal.delete_outputs_on_shutdown", []string{"delete-outputs-on-shutdown"}, renewal.DeleteOutputsOnShutdown},
+		{"renewal.expired_leases_policy", []string{"expired-leases-policy"}, renewal.ExpiredLeasesPolicy},
+		{"renewal.lease_expiry_threshold", []string{"lease-expiry-threshold"}, renewal.LeaseExpiryThreshold},
+	}
+}
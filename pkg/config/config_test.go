@@ -0,0 +1,109 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+func TestLoad(t *testing.T) {
+	c, err := Load("testdata/vaultify.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var address, authMethod, roleIdFile string
+	var timeout time.Duration
+	var skipVerify bool
+	flags := pflag.NewFlagSet(t.Name(), pflag.ContinueOnError)
+	flags.StringVar(&address, "vault", "", "")
+	flags.DurationVar(&timeout, "timeout", time.Minute, "")
+	flags.BoolVar(&skipVerify, "tls-skip-verify", false, "")
+	flags.StringVar(&authMethod, "auth-method", "kubernetes", "")
+	flags.StringVar(&roleIdFile, "role-id-file", "", "")
+	if err := flags.Parse([]string{"--auth-method", "token"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Apply(flags); err != nil {
+		t.Fatal(err)
+	}
+	if address != "https://vault.example.com:8200" || timeout != 5*time.Second || !skipVerify || roleIdFile != "/vault/role-id" {
+		t.Errorf("expected settings from the config file, got %s %v %v %s", address, timeout, skipVerify, roleIdFile)
+	}
+	if authMethod != "token" {
+		t.Errorf("expected flag set on the command line to take precedence, got %s", authMethod)
+	}
+
+	templates := c.TemplateOptions()
+	if len(templates) != 2 {
+		t.Fatalf("expected 2 templates, got %v", templates)
+	}
+	app := templates[0]
+	if app.TemplatePath != "templates/app.yaml" || app.OutputPath != "/app/config.yaml" ||
+		app.Mode != 0640 || app.Uid != 1000 || app.Gid != 0 ||
+		app.OnChangeSignal != "SIGHUP" || app.OnChangeProcessName != "app" {
+		t.Errorf("unexpected template %+v", app)
+	}
+	pgpass := templates[1]
+	if pgpass.Mode != 0 || pgpass.Uid != -1 || pgpass.Gid != -1 {
+		t.Errorf("expected default permissions, got %+v", pgpass)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	tests := []struct {
+		config string
+		err    string
+	}{
+		{"vault:\n  adress: https://vault\n", "line 2: field adress not found"},
+		{"templates:\n  - source: app.yaml\n", "templates[0]: destination is required"},
+		{"templates:\n  - source: app.yaml\n    destination: out.yaml\n    mode: rw\n", "templates[0]: invalid mode 'rw'"},
+		{"templates:\n  - source: app.yaml\n    destination: out.yaml\n    delimiters:\n      left: \"[[\"\n", "templates[0]: delimiters: left and right are required"},
+		{"on_change:\n  signal: SIGHUP\n", "on_change: signal requires pid_file or process"},
+		{"on_change:\n  signal: SIGFOO\n  process: app\n", "on_change: signal:"},
+		{"delimiters:\n  right: \"]]\"\n", "delimiters: left and right are required"},
+		{"output:\n  mode: rw\n", "output.mode: invalid mode 'rw'"},
+		{"renewal:\n  expired_leases_policy: ignore\n", "renewal.expired_leases_policy: unknown policy 'ignore'"},
+		{"renewal:\n  certificate_renew_fraction: 1.5\n", "renewal.certificate_renew_fraction: 1.5 is not between 0 and 1"},
+		{"renewal:\n  restart_on_render: true\n  reload_signal: SIGHUP\n", "renewal.reload_signal: can't be used with restart_on_render"},
+		{"renewal:\n  poll_interval: -1m\n", "renewal.poll_interval: invalid duration '-1m'"},
+		{"templates:\n  - source: app.yaml\n    destination: out.yaml\n    on_change:\n      signal: SIGHUP\n", "templates[0]: on_change: signal requires pid_file or process"},
+	}
+
+	for _, test := range tests {
+		fileName := path.Join(tmpDir, "vaultify.yaml")
+		if err := ioutil.WriteFile(fileName, []byte(test.config), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := Load(fileName)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("expected error containing '%s', got %v", test.err, err)
+		}
+	}
+}
+
+func TestApplyInvalidValue(t *testing.T) {
+	timeout := "5x"
+	c := &Config{Vault: &VaultConfig{Timeout: &timeout}}
+
+	flags := pflag.NewFlagSet(t.Name(), pflag.ContinueOnError)
+	flags.Duration("timeout", time.Minute, "")
+
+	err := c.Apply(flags)
+	if err == nil || !strings.Contains(err.Error(), "vault.timeout") {
+		t.Errorf("expected error for vault.timeout, got %v", err)
+	}
+}
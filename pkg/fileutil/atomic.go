@@ -0,0 +1,150 @@
+package fileutil
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// WriteAtomic writes data to a temporary file in the directory of filename,
+// syncs it, and renames it into place. Readers either see the previous or the
+// complete new content, never a partially written file. An existing file keeps
+// its owner.
+func WriteAtomic(filename string, data []byte, perm os.FileMode) error {
+	return WriteAtomicOwned(filename, data, perm, -1, -1)
+}
+
+// WriteAtomicOwned writes data atomically like WriteAtomic, owned by uid and
+// gid. The owner is set before the file is renamed into place. A uid or gid of
+// -1 keeps the one of the existing file, new files are owned by the user of
+// the process.
+func WriteAtomicOwned(filename string, data []byte, perm os.FileMode, uid, gid int) error {
+	dir := filepath.Dir(filename)
+	tmpFile, err := ioutil.TempFile(dir, "."+filepath.Base(filename)+".")
+	if err != nil {
+		return err
+	}
+	// Fails once the file got renamed
+	defer os.Remove(tmpFile.Name())
+
+	if err := tmpFile.Chmod(perm); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	// The renamed file replaces the existing one, keep its owner
+	configured := uid != -1 || gid != -1
+	if stat, ok := fileOwner(filename); ok {
+		if uid == -1 {
+			uid = int(stat.Uid)
+		}
+		if gid == -1 {
+			gid = int(stat.Gid)
+		}
+	}
+	if err := chownChanged(tmpFile, uid, gid); err != nil {
+		// Without privileges the owner of the existing file can't be kept
+		if configured || !os.IsPermission(err) {
+			tmpFile.Close()
+			return err
+		}
+	}
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpFile.Name(), filename); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// SymlinkAtomic creates a symlink to target, replacing an existing file or
+// symlink at linkname atomically. The symlink is created with a temporary
+// name in the directory of linkname, and renamed into place.
+func SymlinkAtomic(target string, linkname string) error {
+	if existing, err := os.Readlink(linkname); err == nil && existing == target {
+		return nil
+	}
+
+	dir := filepath.Dir(linkname)
+	for {
+		tmpName := filepath.Join(dir, "."+filepath.Base(linkname)+"."+strconv.FormatUint(rand.Uint64(), 36))
+		err := os.Symlink(target, tmpName)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := os.Rename(tmpName, linkname); err != nil {
+			os.Remove(tmpName)
+			return err
+		}
+		return syncDir(dir)
+	}
+}
+
+// fileOwner returns the owner of an existing file.
+func fileOwner(filename string) (*syscall.Stat_t, bool) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, false
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return stat, ok
+}
+
+// chownChanged changes the owner of the file, if it is not owned by uid and
+// gid already.
+func chownChanged(file *os.File, uid, gid int) error {
+	if stat, ok := fileOwner(file.Name()); ok && !ownerChanged(stat, uid, gid) {
+		return nil
+	}
+	return file.Chown(uid, gid)
+}
+
+// ownerChanged returns true if the file is not owned by uid and gid, a uid or
+// gid of -1 matches any.
+func ownerChanged(stat *syscall.Stat_t, uid, gid int) bool {
+	return (uid != -1 && uint32(uid) != stat.Uid) || (gid != -1 && uint32(gid) != stat.Gid)
+}
+
+// SetPermissions changes the mode and owner of an existing file, if they
+// differ. A uid or gid of -1 keeps the current one.
+func SetPermissions(filename string, perm os.FileMode, uid, gid int) error {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	if info.Mode().Perm() != perm {
+		if err := os.Chmod(filename, perm); err != nil {
+			return err
+		}
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && ownerChanged(stat, uid, gid) {
+		return os.Chown(filename, uid, gid)
+	}
+	return nil
+}
+
+// syncDir persists the rename in the directory
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
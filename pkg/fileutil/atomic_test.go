@@ -0,0 +1,80 @@
+package fileutil
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+)
+
+func TestWriteAtomicKeepsOwner(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("changing the owner requires root")
+	}
+
+	tmpDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	fileName := path.Join(tmpDir, "output")
+	if err := ioutil.WriteFile(fileName, []byte("previous"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chown(fileName, 1234, 5678); err != nil {
+		t.Fatal(err)
+	}
+
+	checkOwner := func(uid, gid uint32) {
+		info, err := os.Stat(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stat := info.Sys().(*syscall.Stat_t)
+		if stat.Uid != uid || stat.Gid != gid {
+			t.Errorf("expected owner %d:%d, got %d:%d", uid, gid, stat.Uid, stat.Gid)
+		}
+	}
+
+	if err := WriteAtomic(fileName, []byte("new"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	checkOwner(1234, 5678)
+
+	if err := WriteAtomicOwned(fileName, []byte("owned"), 0600, 4321, -1); err != nil {
+		t.Fatal(err)
+	}
+	checkOwner(4321, 5678)
+}
+
+func TestSymlinkAtomic(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	linkName := path.Join(tmpDir, "link")
+	for _, target := range []string{"first", "second", "second"} {
+		if err := SymlinkAtomic(target, linkName); err != nil {
+			t.Fatal(err)
+		}
+		actual, err := os.Readlink(linkName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual != target {
+			t.Errorf("expected symlink to %s, got %s", target, actual)
+		}
+	}
+
+	files, err := ioutil.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("expected only the symlink, got %d files", len(files))
+	}
+}
@@ -1,12 +1,31 @@
 package leases
 
 import (
+	"time"
+
 	"github.com/ahilsend/vaultify/pkg/options"
 )
 
+const (
+	// ExpiredLeasesPolicyFail fails at startup if leases expired
+	ExpiredLeasesPolicyFail = "fail"
+	// ExpiredLeasesPolicyRerender renders the templates again at startup if
+	// leases expired, or expire soon
+	ExpiredLeasesPolicyRerender = "rerender"
+)
+
+var ExpiredLeasesPolicies = []string{
+	ExpiredLeasesPolicyFail,
+	ExpiredLeasesPolicyRerender,
+}
+
 // Options customizes the parameters of templating.
 type Options struct {
 	options.CommonOptions
+	options.SecretsFileOptions
+	// Templating options, to render the templates again with the rerender
+	// policy
+	options.CommonTemplateOptions
 
 	// Secrets file location, where the secret leases are stored
 	SecretsFileName string
@@ -16,11 +35,34 @@ type Options struct {
 	ListenAddress string
 	// Path to use to expose metrics
 	MetricsPath string
+
+	// Revoke all secret leases and the auth token on shutdown, unless the
+	// token was supplied with the token auth method
+	RevokeOnShutdown bool
+
+	// What to do with expired leases at startup, one of ExpiredLeasesPolicies
+	ExpiredLeasesPolicy string
+	// Leases expiring within this duration at startup are reported
+	LeaseExpiryThreshold time.Duration
 }
 
 // IsValid returns true if some values are filled into the options.
 func (o *Options) IsValid() bool {
-	return o != nil &&
+	if o == nil {
+		return false
+	}
+
+	switch o.ExpiredLeasesPolicy {
+	case ExpiredLeasesPolicyFail:
+	case ExpiredLeasesPolicyRerender:
+		if !o.CommonTemplateOptions.IsValid() {
+			return false
+		}
+	default:
+		return false
+	}
+
+	return o.LeaseExpiryThreshold >= 0 &&
 		o.SecretsFileName != "" &&
 		o.ListenAddress != "" &&
 		o.MetricsPath != ""
@@ -1,41 +1,59 @@
 package leases
 
 import (
-	"context"
+	"errors"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/hashicorp/go-hclog"
 
 	"github.com/ahilsend/vaultify/pkg/http"
+	"github.com/ahilsend/vaultify/pkg/process"
 	"github.com/ahilsend/vaultify/pkg/prometheus"
 	"github.com/ahilsend/vaultify/pkg/secrets"
+	"github.com/ahilsend/vaultify/pkg/template"
 	"github.com/ahilsend/vaultify/pkg/vault"
 )
 
 var retries int
 
 func Run(logger hclog.Logger, options *Options) error {
-	secretResult, err := secrets.Read(options.SecretsFileName)
+	key, err := secrets.ReadKey(options.SecretsKeyFile)
 	if err != nil {
 		return err
 	}
 
-	config := options.VaultApiConfig()
-	vaultClient, err := vault.NewClientFromSecret(logger, secretResult.AuthSecret, config)
+	secretResult, vaultClient, err := startup(logger, options, key)
 	if err != nil {
 		return err
 	}
 
-	ctx := context.Background()
+	ctx, cancel := process.ShutdownContext(logger)
+	defer cancel()
 
 	// Reset the default mux to clear handlers
 	http.NewDefaultMux()
 	prometheus.RegisterHandler(options.MetricsPath)
 	go http.Serve(options.ListenAddress)
+	renewedCh := vaultClient.NotifyRenewed()
+	go persistRenewals(ctx, logger, options, key, secretResult, renewedCh)
 	go vaultClient.StartAuthRenewal(ctx)
 	go vaultClient.RenewLeases(ctx, secretResult.Secrets)
 
 	err = vaultClient.Wait(ctx)
+	cancel()
+	if options.RevokeOnShutdown {
+		if err := vaultClient.RevokeLeases(secretResult.Secrets); err != nil {
+			logger.Error("failed to revoke secret leases", "error", err)
+		}
+		if secretResult.ExternalAuthToken {
+			logger.Info("not revoking the auth token supplied to vaultify")
+		} else if err := vaultClient.RevokeAuthToken(); err != nil {
+			logger.Error("failed to revoke auth token", "error", err)
+		}
+	}
+
 	// We can safely retry fetching the secret as long as we get empty secret data from vault
 	if err == vault.ErrRenewerNoSecretData {
 		if retries <= options.MaxRetries {
@@ -46,3 +64,121 @@ func Run(logger hclog.Logger, options *Options) error {
 	}
 	return err
 }
+
+// startup reads the secrets file, and checks whether the leases in it are
+// still valid. Depending on the policy it fails when leases expired, or
+// renders the templates again to get new leases.
+func startup(logger hclog.Logger, options *Options, key []byte) (*secrets.Secrets, *vault.Client, error) {
+	secretResult, vaultClient, err := readSecrets(logger, options, key)
+	if errors.Is(err, vault.ErrUnwrapFailed) && options.ExpiredLeasesPolicy == ExpiredLeasesPolicyRerender {
+		logger.Warn("auth token can't be unwrapped", "error", err)
+		return rerender(logger, options, key)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	statuses, err := vaultClient.LookupLeases(secretResult.Secrets, options.LeaseExpiryThreshold)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var expired []string
+	for _, status := range statuses {
+		if status.Expired {
+			logger.Warn("lease expired", "name", status.Name)
+			expired = append(expired, status.String())
+		} else {
+			logger.Warn("lease expires soon", "name", status.Name, "ttl", status.TTL)
+		}
+	}
+	if len(statuses) == 0 {
+		return secretResult, vaultClient, nil
+	}
+
+	switch options.ExpiredLeasesPolicy {
+	case ExpiredLeasesPolicyRerender:
+		newResult, newClient, err := rerender(logger, options, key)
+		if err != nil {
+			return nil, nil, err
+		}
+		revokeSuperseded(logger, vaultClient, newClient, secretResult.Secrets, statuses)
+		return newResult, newClient, nil
+
+	default:
+		if len(expired) > 0 {
+			return nil, nil, fmt.Errorf("%d leases in %s expired, render the templates again:\n%s",
+				len(expired), options.SecretsFileName, strings.Join(expired, "\n"))
+		}
+		return secretResult, vaultClient, nil
+	}
+}
+
+// rerender renders the templates again to get new leases, and reads the
+// secrets file written by it.
+func rerender(logger hclog.Logger, options *Options, key []byte) (*secrets.Secrets, *vault.Client, error) {
+	logger.Info("rendering templates again to get new leases")
+	templateOptions := &template.Options{
+		CommonOptions:         options.CommonOptions,
+		CommonTemplateOptions: options.CommonTemplateOptions,
+		SecretsFileOptions:    options.SecretsFileOptions,
+		SecretsOutputFileName: options.SecretsFileName,
+	}
+	if err := template.Run(logger, templateOptions); err != nil {
+		return nil, nil, fmt.Errorf("rendering templates failed: %v", err)
+	}
+	return readSecrets(logger, options, key)
+}
+
+// revokeSuperseded revokes the leases and the auth token of the previous
+// secrets file, replaced by rendering the templates again, so they don't
+// linger until they expire. Failures are logged only, the new leases are
+// renewed anyway.
+func revokeSuperseded(logger hclog.Logger, vaultClient *vault.Client, newClient *vault.Client, previous map[string]secrets.Secret, statuses []vault.LeaseStatus) {
+	// The same token is used again, e.g. with the token auth method
+	sameToken := vaultClient.ApiClient.Token() == newClient.ApiClient.Token()
+	leases, revokeToken := superseded(previous, statuses, sameToken)
+	if err := vaultClient.RevokeLeases(leases); err != nil {
+		logger.Warn("failed to revoke superseded leases", "error", err)
+	}
+	if revokeToken {
+		if err := vaultClient.RevokeAuthToken(); err != nil {
+			logger.Warn("failed to revoke superseded auth token", "error", err)
+		}
+	}
+}
+
+// superseded returns the previous leases that are still valid, and whether
+// to revoke the previous auth token. Leases of an expired auth token are
+// revoked by vault already.
+func superseded(previous map[string]secrets.Secret, statuses []vault.LeaseStatus, sameToken bool) (map[string]secrets.Secret, bool) {
+	leases := map[string]secrets.Secret{}
+	for name, secret := range previous {
+		leases[name] = secret
+	}
+	for _, status := range statuses {
+		if !status.Expired {
+			continue
+		}
+		if status.Name == vault.AuthTokenName {
+			return nil, false
+		}
+		delete(leases, status.Name)
+	}
+	return leases, !sameToken
+}
+
+// readSecrets reads the secrets file, and creates a vault client with the
+// auth token stored in it.
+func readSecrets(logger hclog.Logger, options *Options, key []byte) (*secrets.Secrets, *vault.Client, error) {
+	secretResult, err := secrets.Read(options.SecretsFileName, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	vaultClient, err := vault.NewClientFromSecret(logger, secretResult.AuthSecret, secretResult.AuthExpiry, options.VaultConfig())
+	if err != nil {
+		return nil, nil, err
+	}
+	return secretResult, vaultClient, nil
+}
@@ -0,0 +1,36 @@
+package leases
+
+import (
+	"testing"
+
+	"github.com/ahilsend/vaultify/pkg/secrets"
+	"github.com/ahilsend/vaultify/pkg/vault"
+)
+
+func TestSuperseded(t *testing.T) {
+	previous := map[string]secrets.Secret{
+		"database/creds/app":   {LeaseID: "database/creds/app/1"},
+		"database/creds/admin": {LeaseID: "database/creds/admin/1"},
+	}
+
+	leases, revokeToken := superseded(previous, []vault.LeaseStatus{
+		{Name: "database/creds/app", Expired: true},
+		{Name: "database/creds/admin", TTL: 10},
+	}, false)
+	if _, ok := leases["database/creds/admin"]; !ok || len(leases) != 1 || !revokeToken {
+		t.Errorf("expected the valid lease and the auth token to be revoked, got %v, %v", leases, revokeToken)
+	}
+
+	// The token is used again
+	if _, revokeToken := superseded(previous, nil, true); revokeToken {
+		t.Error("expected the auth token used again not to be revoked")
+	}
+
+	// Leases of an expired token are revoked by vault
+	leases, revokeToken = superseded(previous, []vault.LeaseStatus{
+		{Name: vault.AuthTokenName, Expired: true},
+	}, false)
+	if len(leases) != 0 || revokeToken {
+		t.Errorf("expected nothing to be revoked with an expired auth token, got %v, %v", leases, revokeToken)
+	}
+}
@@ -0,0 +1,58 @@
+package leases
+
+import (
+	"context"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+
+	"github.com/ahilsend/vaultify/pkg/secrets"
+	"github.com/ahilsend/vaultify/pkg/vault"
+)
+
+// persistRenewals writes the lease state to the secrets file whenever a secret
+// lease or the auth token is renewed, so a restart resumes from the current
+// state.
+func persistRenewals(ctx context.Context, logger hclog.Logger, options *Options, key []byte, secretResult *secrets.Secrets, renewedCh <-chan vault.Renewal) {
+	// Work on a copy, the renewed secrets are only owned by this goroutine
+	state := &secrets.Secrets{
+		AuthSecret:  secretResult.AuthSecret,
+		Secrets:     map[string]secrets.Secret{},
+		AuthExpiry:  secretResult.AuthExpiry,
+		LeaseExpiry: map[string]time.Time{},
+
+		ExternalAuthToken: secretResult.ExternalAuthToken,
+	}
+	for name, secret := range secretResult.Secrets {
+		state.Secrets[name] = secret
+	}
+	for name, expiry := range secretResult.LeaseExpiry {
+		state.LeaseExpiry[name] = expiry
+	}
+
+	wrapped := state.AuthSecret != nil && state.AuthSecret.Auth == nil && state.AuthSecret.WrapInfo != nil
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case renewal := <-renewedCh:
+			if renewal.Name == vault.AuthTokenName {
+				// A wrapped auth token is stored only as wrapping token, the
+				// unwrapped token is never written to the file
+				if wrapped {
+					continue
+				}
+				state.UpdateAuth(renewal.Secret, time.Now())
+			} else if !state.UpdateLease(renewal.Name, renewal.Secret, time.Now()) {
+				continue
+			}
+
+			logger.Debug("writing renewed lease state", "name", renewal.Name, "file", options.SecretsFileName)
+			if err := secrets.Write(options.SecretsFileName, state, key); err != nil {
+				logger.Error("failed to write secrets file", "file", options.SecretsFileName, "error", err)
+			}
+		}
+	}
+}
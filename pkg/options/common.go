@@ -1,24 +1,77 @@
 package options
 
 import (
+	"fmt"
 	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/hashicorp/go-retryablehttp"
 	"github.com/hashicorp/vault/api"
 	"golang.org/x/time/rate"
+
+	"github.com/ahilsend/vaultify/pkg/vault"
 )
 
 type CommonOptions struct {
 	VaultAddress string        // VAULT_ADDR
 	Timeout      time.Duration // VAULT_CLIENT_TIMEOUT
 	MaxRetries   int           // VAULT_MAX_RETRIES
+	Namespace    string        // VAULT_NAMESPACE
+
+	CACert        string // VAULT_CACERT
+	CAPath        string // VAULT_CAPATH
+	ClientCert    string // VAULT_CLIENT_CERT
+	ClientKey     string // VAULT_CLIENT_KEY
+	TLSServerName string // VAULT_TLS_SERVER_NAME
+	TLSSkipVerify bool   // VAULT_SKIP_VERIFY
 
 	RateLimit      time.Duration
 	RateLimitBurst int
 }
 
+// AuthOptions configures how to log in to vault.
+type AuthOptions struct {
+	// Auth method, one of vault.AuthMethods, defaults to kubernetes
+	AuthMethod string
+	// Mount path of the auth method, defaults to auth/<method>
+	AuthMountPath string
+
+	// Service account token path, and its expected audience for the
+	// kubernetes auth method
+	KubernetesTokenPath string
+	KubernetesAudience  string
+
+	// Token file for the token auth method, VAULT_TOKEN is used if not set
+	TokenFile string
+	// Role id and secret id files for the approle auth method
+	RoleIdFile   string
+	SecretIdFile string
+	// JWT file for the jwt auth method
+	JwtFile string
+	// Username and password file for the userpass auth method
+	Username     string
+	PasswordFile string
+}
+
+// SecretsFileOptions configures how the secrets file is stored.
+type SecretsFileOptions struct {
+	// Key file to encrypt the secrets file with, VAULTIFY_SECRETS_KEY is used
+	// if not set. The file is stored unencrypted without a key.
+	SecretsKeyFile string
+	// Wrap the auth token in the secrets file with response wrapping, with
+	// this TTL. 0 stores the token itself
+	SecretsWrapTTL time.Duration
+}
+
 type CommonTemplateOptions struct {
+	AuthOptions
+
+	// Role for the kubernetes and jwt auth methods, or certificate role for
+	// the cert auth method
 	Role string
 
 	// Template file to be rendered (deprecated)
@@ -31,6 +84,205 @@ type CommonTemplateOptions struct {
 
 	// Optional, for setting variables to test the templating without vault connection.
 	Variables map[string]string
+
+	// Hook to run when any output file changed
+	HookOptions
+
+	// Default permissions of the output files, for templates without their own.
+	// A nil owner or group keeps the current one.
+	OutputMode   os.FileMode
+	OutputUid    *int
+	OutputGid    *int
+	PreserveMode bool
+
+	// Default file filtering of template directories, for templates without
+	// their own
+	DirectoryOptions
+	// Default delimiters, for templates without their own
+	Delimiters
+
+	// Additional templates to render, e.g. from the configuration file
+	Templates []TemplateConfig
+}
+
+// HookOptions configures what to run when output files changed.
+type HookOptions struct {
+	// Optional shell command to run when an output file changed
+	OnChangeCommand string
+	// Optional signal to send to a process when an output file changed
+	OnChangeSignal string
+	// Pid file of the process to send OnChangeSignal to
+	OnChangePidFile string
+	// Name of the processes to send OnChangeSignal to, if OnChangePidFile is not set
+	OnChangeProcessName string
+}
+
+// IsValid returns false if a signal is configured without a process to send
+// it to.
+func (o *HookOptions) IsValid() bool {
+	return o.OnChangeSignal == "" || o.OnChangePidFile != "" || o.OnChangeProcessName != ""
+}
+
+// DirectoryOptions select and rename the files of a template directory.
+type DirectoryOptions struct {
+	// Glob patterns of the files to render, all files if empty
+	Include []string
+	// Glob patterns of the files and directories to skip
+	Exclude []string
+	// Suffix of template files, stripped from the output files, e.g. .tmpl
+	TemplateSuffix string
+	// Copy files without TemplateSuffix verbatim instead of rendering them
+	CopyNonTemplates bool
+}
+
+// IsValid returns false for malformed patterns, or copying non-template files
+// without a template suffix.
+func (o *DirectoryOptions) IsValid() bool {
+	for _, pattern := range append(o.Include, o.Exclude...) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return false
+		}
+	}
+	return !o.CopyNonTemplates || o.TemplateSuffix != ""
+}
+
+// Delimiters are the action delimiters of templates, empty for the default
+// <{ and }>.
+type Delimiters struct {
+	LeftDelimiter  string
+	RightDelimiter string
+}
+
+// IsValid returns false if only one of the delimiters is set.
+func (o *Delimiters) IsValid() bool {
+	return (o.LeftDelimiter == "") == (o.RightDelimiter == "")
+}
+
+// TemplateConfig is a template file or directory rendered to an output path,
+// with optional permissions of the output files, and a hook to run when they
+// changed.
+type TemplateConfig struct {
+	// Template file or directory to be rendered
+	TemplatePath string
+	// Location of output file or directory
+	OutputPath string
+
+	// Mode of the output files, 0 for the default
+	Mode os.FileMode
+	// Use the mode of the template files if Mode is not set
+	PreserveMode bool
+	// Owner and group of the output files, -1 to keep the current ones
+	Uid int
+	Gid int
+
+	DirectoryOptions
+	Delimiters
+	HookOptions
+}
+
+// NewTemplateConfig returns the config of a template rendered with default
+// permissions.
+func NewTemplateConfig(templatePath, outputPath string) TemplateConfig {
+	return TemplateConfig{
+		TemplatePath: templatePath,
+		OutputPath:   outputPath,
+		Uid:          -1,
+		Gid:          -1,
+	}
+}
+
+// ParseTemplateConfig parses a template path and output path pair, separated
+// by a colon, e.g. templates/app.yaml:/app/config.yaml.
+func ParseTemplateConfig(value string) (TemplateConfig, error) {
+	i := strings.Index(value, ":")
+	if i <= 0 || i == len(value)-1 {
+		return TemplateConfig{}, fmt.Errorf("expected template:output, got '%s'", value)
+	}
+	return NewTemplateConfig(value[:i], value[i+1:]), nil
+}
+
+// ParseFileMode parses octal permissions, e.g. 0640.
+func ParseFileMode(value string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid mode '%s', expected octal permissions like 0640", value)
+	}
+	return os.FileMode(mode), nil
+}
+
+// LookupUid returns a numeric user id as it is, or looks up the id of a user
+// name.
+func LookupUid(nameOrId string) (int, error) {
+	return lookupId(nameOrId, func(name string) (string, error) {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return "", err
+		}
+		return u.Uid, nil
+	})
+}
+
+// LookupGid returns a numeric group id as it is, or looks up the id of a group
+// name.
+func LookupGid(nameOrId string) (int, error) {
+	return lookupId(nameOrId, func(name string) (string, error) {
+		g, err := user.LookupGroup(name)
+		if err != nil {
+			return "", err
+		}
+		return g.Gid, nil
+	})
+}
+
+func lookupId(nameOrId string, lookup func(name string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(nameOrId); err == nil {
+		return id, nil
+	}
+
+	id, err := lookup(nameOrId)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(id)
+}
+
+// TemplateConfigs returns all templates to render, the template path and
+// output path first, if set. Templates without their own permissions get the
+// default output permissions.
+func (o *CommonTemplateOptions) TemplateConfigs() []TemplateConfig {
+	var templates []TemplateConfig
+	if o.TemplatePath != "" {
+		templates = append(templates, NewTemplateConfig(o.TemplatePath, o.OutputPath))
+	}
+	templates = append(templates, o.Templates...)
+
+	for i := range templates {
+		template := &templates[i]
+		if template.Mode == 0 && !template.PreserveMode {
+			template.Mode = o.OutputMode
+			template.PreserveMode = o.PreserveMode
+		}
+		if template.Uid == -1 && o.OutputUid != nil {
+			template.Uid = *o.OutputUid
+		}
+		if template.Gid == -1 && o.OutputGid != nil {
+			template.Gid = *o.OutputGid
+		}
+		if len(template.Include) == 0 {
+			template.Include = o.Include
+		}
+		if len(template.Exclude) == 0 {
+			template.Exclude = o.Exclude
+		}
+		if template.TemplateSuffix == "" {
+			template.TemplateSuffix = o.TemplateSuffix
+			template.CopyNonTemplates = o.CopyNonTemplates
+		}
+		if template.LeftDelimiter == "" && template.RightDelimiter == "" {
+			template.Delimiters = o.Delimiters
+		}
+	}
+	return templates
 }
 
 // IsValid returns true if some values are filled into the options.
@@ -51,11 +303,83 @@ func (o *CommonTemplateOptions) IsValid() bool {
 		o.TemplatePath = o.TemplateFileName
 	}
 
-	if o.TemplatePath == "" || o.OutputPath == "" {
+	if (o.TemplatePath == "") != (o.OutputPath == "") {
+		return false
+	}
+	templates := o.TemplateConfigs()
+	if len(templates) == 0 {
 		return false
 	}
+	for _, template := range templates {
+		if template.TemplatePath == "" || template.OutputPath == "" || !template.HookOptions.IsValid() || !template.DirectoryOptions.IsValid() || !template.Delimiters.IsValid() {
+			return false
+		}
+	}
+
+	if !o.HookOptions.IsValid() {
+		return false
+	}
+
+	return len(o.Variables) > 0 || o.hasAuthCredentials()
+}
+
+// hasAuthCredentials returns true if everything required by the auth method
+// is filled in.
+func (o *CommonTemplateOptions) hasAuthCredentials() bool {
+	switch o.AuthMethod {
+	case "", vault.AuthMethodKubernetes:
+		return o.Role != ""
+	case vault.AuthMethodToken, vault.AuthMethodCert:
+		return true
+	case vault.AuthMethodAppRole:
+		return o.RoleIdFile != "" && o.SecretIdFile != ""
+	case vault.AuthMethodJwt:
+		return o.Role != "" && o.JwtFile != ""
+	case vault.AuthMethodUserpass:
+		return o.Username != "" && o.PasswordFile != ""
+	}
+	return false
+}
+
+func (o *CommonTemplateOptions) VaultAuthConfig() *vault.AuthConfig {
+	return &vault.AuthConfig{
+		Method:              o.AuthMethod,
+		MountPath:           o.AuthMountPath,
+		Role:                o.Role,
+		KubernetesTokenPath: o.KubernetesTokenPath,
+		KubernetesAudience:  o.KubernetesAudience,
+		TokenFile:           o.TokenFile,
+		RoleIdFile:          o.RoleIdFile,
+		SecretIdFile:        o.SecretIdFile,
+		JwtFile:             o.JwtFile,
+		Username:            o.Username,
+		PasswordFile:        o.PasswordFile,
+	}
+}
 
-	return len(o.Variables) > 0 || o.Role != ""
+func (o *CommonOptions) VaultConfig() *vault.Config {
+	return &vault.Config{
+		Config:    o.VaultApiConfig(),
+		Namespace: o.Namespace,
+		TLS:       o.vaultTLSConfig(),
+	}
+}
+
+// vaultTLSConfig returns nil if no TLS settings are set, to only use the
+// settings from the environment.
+func (o *CommonOptions) vaultTLSConfig() *api.TLSConfig {
+	tlsConfig := &api.TLSConfig{
+		CACert:        o.CACert,
+		CAPath:        o.CAPath,
+		ClientCert:    o.ClientCert,
+		ClientKey:     o.ClientKey,
+		TLSServerName: o.TLSServerName,
+		Insecure:      o.TLSSkipVerify,
+	}
+	if *tlsConfig == (api.TLSConfig{}) {
+		return nil
+	}
+	return tlsConfig
 }
 
 func (o *CommonOptions) VaultApiConfig() *api.Config {
@@ -0,0 +1,19 @@
+package options
+
+import "testing"
+
+func TestParseTemplateConfig(t *testing.T) {
+	template, err := ParseTemplateConfig("templates/app.yaml:/app/config.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if template.TemplatePath != "templates/app.yaml" || template.OutputPath != "/app/config.yaml" || template.Uid != -1 || template.Gid != -1 {
+		t.Errorf("unexpected template %+v", template)
+	}
+
+	for _, value := range []string{"templates/app.yaml", ":/app/config.yaml", "templates/app.yaml:"} {
+		if _, err := ParseTemplateConfig(value); err == nil {
+			t.Errorf("expected error for '%s'", value)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package process
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// Hook runs a command and/or sends a signal to a process, e.g. to let it
+// reload its configuration after an output file changed.
+type Hook struct {
+	logger hclog.Logger
+
+	// Shell command to run
+	command string
+	// Signal to send to the process found by pidFile or processName
+	signal      os.Signal
+	pidFile     string
+	processName string
+}
+
+// NewHook returns a hook running command and/or sending a signal to the
+// process with the pid in pidFile, or all processes named processName.
+// Returns nil if neither a command nor a signal is configured.
+func NewHook(logger hclog.Logger, command string, signalName string, pidFile string, processName string) (*Hook, error) {
+	if command == "" && signalName == "" {
+		return nil, nil
+	}
+
+	hook := &Hook{
+		logger:      logger,
+		command:     command,
+		pidFile:     pidFile,
+		processName: processName,
+	}
+
+	if signalName != "" {
+		if pidFile == "" && processName == "" {
+			return nil, fmt.Errorf("a pid file or process name is required to send %s", signalName)
+		}
+		sig, err := ParseSignal(signalName)
+		if err != nil {
+			return nil, err
+		}
+		hook.signal = sig
+	}
+	return hook, nil
+}
+
+// Run runs the hook for the given changed files. The changed files are
+// passed to the command as VAULTIFY_CHANGED_FILES, separated by newlines.
+func (h *Hook) Run(changedFiles []string) error {
+	if h.command != "" {
+		h.logger.Info("running hook command", "command", h.command)
+		cmd := exec.Command("sh", "-c", h.command)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		cmd.Env = append(os.Environ(), "VAULTIFY_CHANGED_FILES="+strings.Join(changedFiles, "\n"))
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("hook command failed: %v", err)
+		}
+	}
+
+	if h.signal == nil {
+		return nil
+	}
+
+	pids, err := h.pids()
+	if err != nil {
+		return err
+	}
+	for _, pid := range pids {
+		process, err := os.FindProcess(pid)
+		if err != nil {
+			return err
+		}
+		h.logger.Info("sending signal to process", "signal", h.signal, "pid", pid)
+		if err := process.Signal(h.signal); err != nil {
+			return fmt.Errorf("failed to send %v to process %d: %v", h.signal, pid, err)
+		}
+	}
+	return nil
+}
+
+func (h *Hook) pids() ([]int, error) {
+	if h.pidFile != "" {
+		content, err := ioutil.ReadFile(h.pidFile)
+		if err != nil {
+			return nil, err
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+		if err != nil {
+			return nil, fmt.Errorf("invalid pid file %s: %v", h.pidFile, err)
+		}
+		return []int{pid}, nil
+	}
+
+	pids, err := findProcesses(h.processName)
+	if err != nil {
+		return nil, err
+	}
+	if len(pids) == 0 {
+		return nil, fmt.Errorf("no process named '%s' found", h.processName)
+	}
+	return pids, nil
+}
+
+// findProcesses returns the pids of all processes with the given name, by
+// their name in /proc/<pid>/comm or the base name of their executable.
+func findProcesses(name string) ([]int, error) {
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+
+	var pids []int
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+
+		comm, err := ioutil.ReadFile(filepath.Join("/proc", entry.Name(), "comm"))
+		if err != nil {
+			// process exited in the meantime
+			continue
+		}
+		if strings.TrimSpace(string(comm)) == name {
+			pids = append(pids, pid)
+			continue
+		}
+
+		cmdline, err := ioutil.ReadFile(filepath.Join("/proc", entry.Name(), "cmdline"))
+		if err != nil {
+			continue
+		}
+		args := strings.SplitN(string(cmdline), "\x00", 2)
+		if len(args) > 0 && args[0] != "" && filepath.Base(args[0]) == name {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
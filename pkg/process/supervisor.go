@@ -0,0 +1,264 @@
+package process
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// Signals forwarded to the supervised process
+var forwardedSignals = []os.Signal{
+	syscall.SIGINT,
+	syscall.SIGTERM,
+	syscall.SIGHUP,
+	syscall.SIGQUIT,
+	syscall.SIGUSR1,
+	syscall.SIGUSR2,
+}
+
+// ExitError is returned when the supervised process exited with a non zero
+// exit code.
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("process exited with code %d", e.Code)
+}
+
+// Supervisor starts a process, forwards signals to it, and reports when it
+// exited.
+type Supervisor struct {
+	logger  hclog.Logger
+	command []string
+
+	// Restart the process on Reload
+	restartOnReload bool
+	// Signal to send to the process on Reload
+	reloadSignal os.Signal
+	// Time to wait for the process to exit before killing it
+	stopTimeout time.Duration
+
+	mutex    sync.Mutex
+	cmd      *exec.Cmd
+	exited   chan struct{}
+	doneCh   chan error
+	signalCh chan os.Signal
+	stopped  bool
+	// The process exited on its own or could not be restarted, it is not
+	// started again
+	finished bool
+	// Signals received while restarting, sent to the restarted process
+	restarting     bool
+	pendingSignals []os.Signal
+}
+
+func NewSupervisor(logger hclog.Logger, command []string, restartOnReload bool, reloadSignal os.Signal) *Supervisor {
+	return &Supervisor{
+		logger:          logger,
+		command:         command,
+		restartOnReload: restartOnReload,
+		reloadSignal:    reloadSignal,
+		stopTimeout:     10 * time.Second,
+		doneCh:          make(chan error, 1),
+		signalCh:        make(chan os.Signal, 1),
+	}
+}
+
+// DoneCh receives the result of the process once it exited, nil if it exited
+// successfully, an *ExitError otherwise, or the error of restarting it.
+func (s *Supervisor) DoneCh() <-chan error {
+	return s.doneCh
+}
+
+// Start starts the process and forwards all received signals to it.
+func (s *Supervisor) Start() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.start(); err != nil {
+		return err
+	}
+
+	signal.Notify(s.signalCh, forwardedSignals...)
+	go s.forwardSignals()
+	return nil
+}
+
+// Reload restarts or signals the process, depending on the configuration.
+func (s *Supervisor) Reload() error {
+	if s.restartOnReload {
+		return s.Restart()
+	}
+	if s.reloadSignal != nil {
+		return s.Signal(s.reloadSignal)
+	}
+	return nil
+}
+
+// Restart stops the process and starts it again. Signals received meanwhile
+// are sent to the restarted process. If it can't be started, the error is
+// reported on the done channel, as there is no process left to supervise.
+// Nothing is restarted once the process exited on its own, or Stop was
+// called.
+func (s *Supervisor) Restart() error {
+	s.mutex.Lock()
+	if s.finished || s.stopped {
+		s.mutex.Unlock()
+		s.logger.Info("process is not running anymore, not restarting it", "command", s.command[0])
+		return nil
+	}
+	s.restarting = true
+	s.mutex.Unlock()
+
+	s.logger.Info("restarting process", "command", s.command[0])
+	s.stop()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	pendingSignals := s.pendingSignals
+	s.restarting = false
+	s.pendingSignals = nil
+
+	// Stopped or exited meanwhile
+	if s.finished || s.stopped {
+		return nil
+	}
+	if err := s.start(); err != nil {
+		err = fmt.Errorf("failed to restart process: %w", err)
+		s.finish(err)
+		return err
+	}
+
+	for _, sig := range pendingSignals {
+		s.logger.Info("sending signal to process", "signal", sig, "pid", s.cmd.Process.Pid)
+		if err := s.cmd.Process.Signal(sig); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Signal sends a signal to the process.
+func (s *Supervisor) Signal(sig os.Signal) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.cmd == nil {
+		if s.restarting {
+			s.pendingSignals = append(s.pendingSignals, sig)
+		}
+		return nil
+	}
+	s.logger.Info("sending signal to process", "signal", sig, "pid", s.cmd.Process.Pid)
+	return s.cmd.Process.Signal(sig)
+}
+
+// Stop stops forwarding signals and terminates the process. The exit of the
+// process is not reported on the done channel.
+func (s *Supervisor) Stop() {
+	signal.Stop(s.signalCh)
+	s.mutex.Lock()
+	if !s.stopped {
+		s.stopped = true
+		// Ends forwardSignals
+		close(s.signalCh)
+	}
+	s.mutex.Unlock()
+	s.stop()
+}
+
+func (s *Supervisor) start() error {
+	cmd := exec.Command(s.command[0], s.command[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	s.logger.Info("started process", "command", s.command[0], "pid", cmd.Process.Pid)
+
+	exited := make(chan struct{})
+	s.cmd = cmd
+	s.exited = exited
+	go s.wait(cmd, exited)
+	return nil
+}
+
+func (s *Supervisor) stop() {
+	s.mutex.Lock()
+	cmd, exited := s.cmd, s.exited
+	s.cmd = nil
+	s.mutex.Unlock()
+
+	if cmd == nil {
+		return
+	}
+
+	s.logger.Info("stopping process", "pid", cmd.Process.Pid)
+	cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case <-exited:
+	case <-time.After(s.stopTimeout):
+		s.logger.Warn("process did not exit in time, killing it", "pid", cmd.Process.Pid)
+		cmd.Process.Kill()
+		<-exited
+	}
+}
+
+func (s *Supervisor) wait(cmd *exec.Cmd, exited chan struct{}) {
+	cmd.Wait()
+	close(exited)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	// The process was stopped or restarted on purpose
+	if s.cmd != cmd {
+		return
+	}
+	s.cmd = nil
+
+	code := exitCode(cmd.ProcessState)
+	s.logger.Info("process exited", "pid", cmd.Process.Pid, "code", code)
+	if code == 0 {
+		s.finish(nil)
+	} else {
+		s.finish(&ExitError{Code: code})
+	}
+}
+
+// finish marks the supervisor as finished, and reports the result on the done
+// channel. Only the first result is reported. The mutex has to be held.
+func (s *Supervisor) finish(err error) {
+	if s.finished {
+		return
+	}
+	s.finished = true
+	select {
+	case s.doneCh <- err:
+	default:
+	}
+}
+
+func (s *Supervisor) forwardSignals() {
+	for sig := range s.signalCh {
+		if err := s.Signal(sig); err != nil {
+			s.logger.Error("failed to forward signal", "signal", sig, "error", err)
+		}
+	}
+}
+
+func exitCode(state *os.ProcessState) int {
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		// Same as shells report processes killed by a signal
+		return 128 + int(status.Signal())
+	}
+	return state.ExitCode()
+}
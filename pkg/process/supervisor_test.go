@@ -0,0 +1,156 @@
+package process
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+func TestSupervisorExitCode(t *testing.T) {
+	supervisor := NewSupervisor(hclog.Default(), []string{"sh", "-c", "exit 3"}, false, nil)
+	if err := supervisor.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer supervisor.Stop()
+
+	err := waitDone(t, supervisor)
+	exitErr, ok := err.(*ExitError)
+	if !ok || exitErr.Code != 3 {
+		t.Errorf("expected exit code 3, got %v", err)
+	}
+}
+
+func TestSupervisorRestart(t *testing.T) {
+	supervisor := NewSupervisor(hclog.Default(), []string{"sleep", "10"}, true, nil)
+	if err := supervisor.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer supervisor.Stop()
+
+	pid := supervisor.cmd.Process.Pid
+	if err := supervisor.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if supervisor.cmd.Process.Pid == pid {
+		t.Error("expected process to be restarted")
+	}
+
+	select {
+	case err := <-supervisor.DoneCh():
+		t.Errorf("restart should not be reported as exit, got %v", err)
+	default:
+	}
+
+	supervisor.Signal(syscall.SIGKILL)
+	err := waitDone(t, supervisor)
+	if exitErr, ok := err.(*ExitError); !ok || exitErr.Code != 128+int(syscall.SIGKILL) {
+		t.Errorf("expected process to be killed, got %v", err)
+	}
+}
+
+func TestSupervisorRestartFailed(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	command := path.Join(tmpDir, "command")
+	if err := ioutil.WriteFile(command, []byte("#!/bin/sh\nexec sleep 10\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	supervisor := NewSupervisor(hclog.Default(), []string{command}, true, nil)
+	if err := supervisor.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer supervisor.Stop()
+
+	if err := os.Remove(command); err != nil {
+		t.Fatal(err)
+	}
+	if err := supervisor.Reload(); err == nil {
+		t.Error("expected restart to fail")
+	}
+
+	err = waitDone(t, supervisor)
+	if _, ok := err.(*ExitError); ok || err == nil {
+		t.Errorf("expected restart error to be reported, got %v", err)
+	}
+}
+
+func TestSupervisorSignalWhileRestarting(t *testing.T) {
+	supervisor := NewSupervisor(hclog.Default(), []string{"sleep", "10"}, true, nil)
+	if err := supervisor.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer supervisor.Stop()
+
+	// Signal received after the process got stopped for the restart
+	supervisor.stop()
+	supervisor.restarting = true
+	if err := supervisor.Signal(syscall.SIGKILL); err != nil {
+		t.Fatal(err)
+	}
+	supervisor.restarting = false
+
+	if err := supervisor.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	err := waitDone(t, supervisor)
+	if exitErr, ok := err.(*ExitError); !ok || exitErr.Code != 128+int(syscall.SIGKILL) {
+		t.Errorf("expected restarted process to be killed, got %v", err)
+	}
+}
+
+func waitDone(t *testing.T, supervisor *Supervisor) error {
+	select {
+	case err := <-supervisor.DoneCh():
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("process did not exit")
+	}
+	return nil
+}
+
+func TestSupervisorRestartAfterExit(t *testing.T) {
+	supervisor := NewSupervisor(hclog.Default(), []string{"true"}, true, nil)
+	if err := supervisor.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer supervisor.Stop()
+
+	if err := waitDone(t, supervisor); err != nil {
+		t.Fatalf("expected process to exit successfully, got %v", err)
+	}
+
+	// The exited process is not started again
+	if err := supervisor.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	supervisor.mutex.Lock()
+	cmd := supervisor.cmd
+	supervisor.mutex.Unlock()
+	if cmd != nil {
+		t.Errorf("expected exited process not to be restarted, got pid %d", cmd.Process.Pid)
+	}
+}
+
+func TestSupervisorRestartAfterStop(t *testing.T) {
+	supervisor := NewSupervisor(hclog.Default(), []string{"sleep", "10"}, true, nil)
+	if err := supervisor.Start(); err != nil {
+		t.Fatal(err)
+	}
+	supervisor.Stop()
+
+	if err := supervisor.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	if supervisor.cmd != nil {
+		t.Errorf("expected stopped process not to be restarted, got pid %d", supervisor.cmd.Process.Pid)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"runtime"
 	"strconv"
+	"time"
 
 	"github.com/ahilsend/vaultify/pkg"
 
@@ -33,6 +34,13 @@ var (
 		},
 		[]string{"role"},
 	)
+	authReauthenticated = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "vaultify_auth_reauthenticated",
+			Help: "Counter for logins after the auth lease could not be renewed anymore",
+		},
+		[]string{"role"},
+	)
 	secretLeaseRenewed = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "vaultify_secret_lease_renewed",
@@ -47,6 +55,13 @@ var (
 		},
 		[]string{"role", "secret"},
 	)
+	certificateExpiry = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "vaultify_certificate_expiry_timestamp_seconds",
+			Help: "Expiry of issued certificates as unix timestamp",
+		},
+		[]string{"role", "secret"},
+	)
 )
 
 func init() {
@@ -54,8 +69,10 @@ func init() {
 	prometheus.MustRegister(buildInfo)
 	prometheus.MustRegister(authLeaseRenewed)
 	prometheus.MustRegister(authLeaseFailed)
+	prometheus.MustRegister(authReauthenticated)
 	prometheus.MustRegister(secretLeaseRenewed)
 	prometheus.MustRegister(secretLeaseFailed)
+	prometheus.MustRegister(certificateExpiry)
 
 	buildInfo.With(prometheus.Labels{
 		"version":     pkg.Version,
@@ -77,6 +94,12 @@ func IncAuthLeaseFailed(role string) {
 	}).Inc()
 }
 
+func IncAuthReauthenticated(role string) {
+	authReauthenticated.With(prometheus.Labels{
+		"role": role,
+	}).Inc()
+}
+
 func IncSecretLeaseRenewed(role string, secret string, hasWarnings bool) {
 	secretLeaseRenewed.With(prometheus.Labels{
 		"role":     role,
@@ -92,6 +115,20 @@ func IncSecretLeaseFailed(role string, secret string) {
 	}).Inc()
 }
 
+func SetCertificateExpiry(role string, secret string, notAfter time.Time) {
+	certificateExpiry.With(prometheus.Labels{
+		"role":   role,
+		"secret": secret,
+	}).Set(float64(notAfter.Unix()))
+}
+
+func DeleteCertificateExpiry(role string, secret string) {
+	certificateExpiry.Delete(prometheus.Labels{
+		"role":   role,
+		"secret": secret,
+	})
+}
+
 func RegisterHandler(metricsPath string) {
 	http.Handle(metricsPath, promhttp.Handler())
 }
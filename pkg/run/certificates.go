@@ -0,0 +1,139 @@
+package run
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+
+	"github.com/ahilsend/vaultify/pkg/prometheus"
+	"github.com/ahilsend/vaultify/pkg/secrets"
+)
+
+// Minimum delay before issuing a certificate again, e.g. when its renewal is
+// due already
+var minCertificateRenewDelay = 30 * time.Second
+
+// certificateScheduler schedules issuing certificates of the PKI secret
+// engine again, after a fraction of their validity passed.
+type certificateScheduler struct {
+	logger       hclog.Logger
+	role         string
+	fraction     float64
+	certificates map[string]scheduledCertificate
+	renewCh      chan string
+}
+
+// scheduledCertificate is a certificate that is scheduled to be issued again.
+type scheduledCertificate struct {
+	timer    *time.Timer
+	notAfter time.Time
+	renewAt  time.Time
+}
+
+func newCertificateScheduler(logger hclog.Logger, role string, fraction float64) *certificateScheduler {
+	return &certificateScheduler{
+		logger:       logger,
+		role:         role,
+		fraction:     fraction,
+		certificates: map[string]scheduledCertificate{},
+		renewCh:      make(chan string),
+	}
+}
+
+// schedule publishes the name of every secret of secretMap containing a
+// certificate on renewCh, once it needs to be issued again. secretMap holds
+// all secrets written with 'vaultWrite'. Certificates keep their schedule
+// until they are issued again with a new expiry, certificates no longer in
+// secretMap are not issued again anymore.
+func (s *certificateScheduler) schedule(ctx context.Context, secretMap map[string]secrets.Secret) {
+	for name := range s.certificates {
+		if _, ok := secretMap[name]; !ok {
+			s.remove(name)
+		}
+	}
+
+	for name, secret := range secretMap {
+		certificate := parseCertificate(secret)
+		if certificate == nil {
+			s.remove(name)
+			continue
+		}
+
+		if scheduled, ok := s.certificates[name]; ok && scheduled.notAfter.Equal(certificate.NotAfter) {
+			if !time.Now().Before(scheduled.renewAt) {
+				s.logger.Warn("certificate was not issued again, it expires without being renewed",
+					"name", name,
+					"notAfter", certificate.NotAfter)
+			}
+			continue
+		}
+
+		validity := certificate.NotAfter.Sub(certificate.NotBefore)
+		renewAt := certificate.NotBefore.Add(time.Duration(float64(validity) * s.fraction))
+		if minRenewAt := time.Now().Add(minCertificateRenewDelay); renewAt.Before(minRenewAt) {
+			renewAt = minRenewAt
+		}
+		prometheus.SetCertificateExpiry(s.role, name, certificate.NotAfter)
+		s.logger.Info("scheduled issuing certificate again",
+			"name", name,
+			"notAfter", certificate.NotAfter,
+			"renewAt", renewAt)
+
+		if scheduled, ok := s.certificates[name]; ok {
+			scheduled.timer.Stop()
+		}
+		// local copy for the closure
+		secretName := name
+		s.certificates[name] = scheduledCertificate{
+			timer: time.AfterFunc(time.Until(renewAt), func() {
+				select {
+				case <-ctx.Done():
+				case s.renewCh <- secretName:
+				}
+			}),
+			notAfter: certificate.NotAfter,
+			renewAt:  renewAt,
+		}
+	}
+}
+
+// remove stops issuing the certificate of a secret again, and removes its
+// expiry metric.
+func (s *certificateScheduler) remove(name string) {
+	scheduled, ok := s.certificates[name]
+	if !ok {
+		return
+	}
+	scheduled.timer.Stop()
+	delete(s.certificates, name)
+	prometheus.DeleteCertificateExpiry(s.role, name)
+}
+
+func (s *certificateScheduler) stop() {
+	for _, scheduled := range s.certificates {
+		scheduled.timer.Stop()
+	}
+}
+
+// parseCertificate returns the certificate issued by the PKI secret engine, or
+// nil if the secret does not contain a certificate.
+func parseCertificate(secret secrets.Secret) *x509.Certificate {
+	pemCertificate, ok := secret.Data["certificate"].(string)
+	if !ok {
+		return nil
+	}
+
+	block, _ := pem.Decode([]byte(pemCertificate))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil
+	}
+
+	certificate, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil
+	}
+	return certificate
+}
@@ -0,0 +1,128 @@
+package run
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/ahilsend/vaultify/pkg/secrets"
+)
+
+func TestCertificateScheduler(t *testing.T) {
+	defer func(delay time.Duration) { minCertificateRenewDelay = delay }(minCertificateRenewDelay)
+	minCertificateRenewDelay = 100 * time.Millisecond
+
+	// The renewal is due already
+	now := time.Now()
+	certificate := createCertificate(t, now.Add(-time.Hour), now.Add(time.Hour))
+	written := map[string]secrets.Secret{
+		"pki/issue/web": {
+			Data: map[string]interface{}{"certificate": certificate},
+		},
+		"transit/encrypt/app": {
+			Data: map[string]interface{}{"ciphertext": "vault:v1:abc"},
+		},
+	}
+
+	scheduler := newCertificateScheduler(hclog.Default(), "app", 0.5)
+	defer scheduler.stop()
+	scheduler.schedule(context.Background(), written)
+	if len(scheduler.certificates) != 1 {
+		t.Errorf("expected only the certificate to be scheduled, got %d", len(scheduler.certificates))
+	}
+
+	select {
+	case name := <-scheduler.renewCh:
+		if name != "pki/issue/web" {
+			t.Errorf("expected pki/issue/web to be issued again, got %s", name)
+		}
+		if elapsed := time.Since(now); elapsed < minCertificateRenewDelay {
+			t.Errorf("expected a due certificate to be issued again after %v, got %v", minCertificateRenewDelay, elapsed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("certificate was not scheduled to be issued again")
+	}
+
+	// The same certificate is not scheduled again
+	scheduler.schedule(context.Background(), written)
+	select {
+	case name := <-scheduler.renewCh:
+		t.Errorf("expected the unchanged certificate %s not to be issued again", name)
+	case <-time.After(3 * minCertificateRenewDelay):
+	}
+
+	// A new certificate is scheduled
+	notAfter := now.Add(2 * time.Hour).Truncate(time.Second)
+	written["pki/issue/web"] = secrets.Secret{
+		Data: map[string]interface{}{"certificate": createCertificate(t, now, notAfter)},
+	}
+	scheduler.schedule(context.Background(), written)
+	if scheduled := scheduler.certificates["pki/issue/web"]; !scheduled.notAfter.Equal(notAfter) {
+		t.Errorf("expected the new certificate expiring at %v to be scheduled, got %v", notAfter, scheduled.notAfter)
+	}
+	if expiry, ok := certificateExpiry(t, "app", "pki/issue/web"); !ok || expiry != float64(notAfter.Unix()) {
+		t.Errorf("expected certificate expiry metric %d, got %v", notAfter.Unix(), expiry)
+	}
+
+	// Certificates no longer used are not issued again
+	scheduler.schedule(context.Background(), map[string]secrets.Secret{})
+	if len(scheduler.certificates) != 0 {
+		t.Errorf("expected no certificates to be scheduled, got %d", len(scheduler.certificates))
+	}
+	if _, ok := certificateExpiry(t, "app", "pki/issue/web"); ok {
+		t.Error("expected the certificate expiry metric to be removed")
+	}
+}
+
+// certificateExpiry returns the value of the certificate expiry metric of a
+// secret, if it exists.
+func certificateExpiry(t *testing.T, role string, secret string) (float64, bool) {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != "vaultify_certificate_expiry_timestamp_seconds" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			labels := map[string]string{}
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			if labels["role"] == role && labels["secret"] == secret {
+				return metric.GetGauge().GetValue(), true
+			}
+		}
+	}
+	return 0, false
+}
+
+func createCertificate(t *testing.T, notBefore time.Time, notAfter time.Time) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "app.example.com"},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
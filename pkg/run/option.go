@@ -1,6 +1,8 @@
 package run
 
 import (
+	"time"
+
 	"github.com/ahilsend/vaultify/pkg/options"
 )
 
@@ -13,6 +15,25 @@ type Options struct {
 	MetricsAddress string
 	// Path to use to expose metrics
 	MetricsPath string
+
+	// Optional command to start after templates are rendered, vaultify
+	// exits with its exit code
+	Command []string
+	// Restart the command when templates are rendered again
+	RestartOnRender bool
+	// Signal to send to the command when templates are rendered again
+	ReloadSignal string
+
+	// Fraction of the validity of PKI certificates after which they are issued again
+	CertificateRenewFraction float64
+	// Interval to read secrets without a lease again, 0 disables polling
+	PollInterval time.Duration
+
+	// Revoke all secret leases and the auth token on shutdown, unless the
+	// token was supplied with the token auth method
+	RevokeOnShutdown bool
+	// Remove all rendered output files on shutdown
+	DeleteOutputsOnShutdown bool
 }
 
 // IsValid returns true if some values are filled into the options.
@@ -21,6 +42,16 @@ func (o *Options) IsValid() bool {
 		return false
 	}
 
+	if o.RestartOnRender && o.ReloadSignal != "" {
+		return false
+	}
+	if o.CertificateRenewFraction <= 0 || o.CertificateRenewFraction >= 1 {
+		return false
+	}
+	if o.PollInterval < 0 {
+		return false
+	}
+
 	return o.CommonTemplateOptions.IsValid() &&
 		o.MetricsAddress != "" &&
 		o.MetricsPath != ""
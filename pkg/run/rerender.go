@@ -0,0 +1,121 @@
+package run
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+
+	"github.com/ahilsend/vaultify/pkg/process"
+	"github.com/ahilsend/vaultify/pkg/template"
+	"github.com/ahilsend/vaultify/pkg/vault"
+)
+
+// rerenderer renders the templates again with new secrets, when secrets
+// expire, or certificates need to be issued again.
+type rerenderer struct {
+	logger        hclog.Logger
+	vaultClient   *vault.Client
+	vaultTemplate *template.VaultifyTemplate
+	supervisor    *process.Supervisor
+	hooks         *template.Hooks
+	certificates  *certificateScheduler
+	pollInterval  time.Duration
+
+	// Closed once run returned
+	done chan struct{}
+}
+
+func (r *rerenderer) run(ctx context.Context, expiredCh <-chan string) {
+	defer close(r.done)
+	defer r.certificates.stop()
+
+	// A nil channel never receives, polling is disabled without an interval
+	var pollCh <-chan time.Time
+	if r.pollInterval > 0 {
+		ticker := time.NewTicker(r.pollInterval)
+		defer ticker.Stop()
+		pollCh = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case name := <-expiredCh:
+			r.logger.Info("rendering templates with new secret", "name", name)
+			if err := r.rerender(ctx, name); err != nil {
+				r.fail(ctx, err)
+				return
+			}
+
+		case name := <-r.certificates.renewCh:
+			r.logger.Info("rendering templates with new certificate", "name", name)
+			if err := r.rerender(ctx, name); err != nil {
+				r.fail(ctx, err)
+				return
+			}
+
+		case <-pollCh:
+			r.refreshStatic()
+		}
+	}
+}
+
+// fail reports the error to the vault client, unless vaultify is shutting
+// down already.
+func (r *rerenderer) fail(ctx context.Context, err error) {
+	select {
+	case r.vaultClient.DoneCh() <- err:
+	case <-ctx.Done():
+	}
+}
+
+// refreshStatic reads the secrets without a lease again, and renders the
+// templates using the changed ones. Errors are logged, the previous outputs
+// stay in place.
+func (r *rerenderer) refreshStatic() {
+	changed, err := r.vaultTemplate.RefreshStatic()
+	if err != nil {
+		r.logger.Error("failed to refresh static secrets", "error", err)
+		return
+	}
+	if len(changed) == 0 {
+		return
+	}
+	r.logger.Info("rendered templates with changed static secrets", "names", changed)
+	r.reload()
+}
+
+// rerender reads the secret again, renders the templates using it, and
+// starts renewing the new leases.
+func (r *rerenderer) rerender(ctx context.Context, name string) error {
+	renewed, err := r.vaultTemplate.Rerender(name)
+	if err != nil {
+		return fmt.Errorf("rendering templates for secret %s failed: %v", name, err)
+	}
+
+	for renewedName, secret := range renewed {
+		if err := r.vaultClient.RenewLease(ctx, renewedName, secret); err != nil {
+			return err
+		}
+	}
+	r.certificates.schedule(ctx, r.vaultTemplate.WrittenSecrets())
+
+	r.reload()
+	return nil
+}
+
+// reload runs the hooks and reloads the supervised process after rendering.
+func (r *rerenderer) reload() {
+	if err := template.RunHooks(r.hooks, r.vaultTemplate); err != nil {
+		r.logger.Error("failed to run hooks", "error", err)
+	}
+	if r.supervisor != nil {
+		if err := r.supervisor.Reload(); err != nil {
+			r.logger.Error("failed to reload process", "error", err)
+		}
+	}
+}
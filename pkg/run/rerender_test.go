@@ -0,0 +1,33 @@
+package run
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+
+	"github.com/ahilsend/vaultify/pkg/secrets"
+	"github.com/ahilsend/vaultify/pkg/template"
+)
+
+func TestRerendererDone(t *testing.T) {
+	r := &rerenderer{
+		logger:        hclog.Default(),
+		vaultTemplate: template.New(hclog.Default(), secrets.NewMapReader(secrets.MapSecrets{})),
+		certificates:  newCertificateScheduler(hclog.Default(), "app", 0.5),
+		pollInterval:  time.Millisecond,
+		done:          make(chan struct{}),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go r.run(ctx, make(chan string))
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	select {
+	case <-r.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("rerenderer did not stop")
+	}
+}
@@ -2,11 +2,13 @@ package run
 
 import (
 	"context"
+	"os"
 	"time"
 
 	"github.com/hashicorp/go-hclog"
 
 	"github.com/ahilsend/vaultify/pkg/http"
+	"github.com/ahilsend/vaultify/pkg/process"
 	"github.com/ahilsend/vaultify/pkg/prometheus"
 	"github.com/ahilsend/vaultify/pkg/secrets"
 	"github.com/ahilsend/vaultify/pkg/template"
@@ -16,13 +18,31 @@ import (
 var retries int
 
 func Run(logger hclog.Logger, options *Options) error {
-	config := options.VaultApiConfig()
-	vaultClient, err := vault.NewClient(logger, options.Role, config)
+	supervisor, err := newSupervisor(logger, options)
+	if err != nil {
+		return err
+	}
+	hooks, err := template.NewHooks(logger, options.CommonTemplateOptions)
+	if err != nil {
+		return err
+	}
+
+	config := options.VaultConfig()
+	vaultClient, err := vault.NewClient(logger, options.VaultAuthConfig(), config)
 	if err != nil {
 		return err
 	}
 
-	ctx := context.Background()
+	// A supervised process receives the signals instead, vaultify shuts down
+	// once it exited
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if supervisor != nil {
+		ctx, cancel = context.WithCancel(context.Background())
+	} else {
+		ctx, cancel = process.ShutdownContext(logger)
+	}
+	defer cancel()
 
 	// Reset the default mux to clear handlers
 	http.NewDefaultMux()
@@ -36,10 +56,43 @@ func Run(logger hclog.Logger, options *Options) error {
 	if err != nil {
 		return err
 	}
+	if err := template.RunHooks(hooks, vaultTemplate); err != nil {
+		logger.Error("failed to run hooks", "error", err)
+	}
 
-	go vaultClient.RenewLeases(ctx, resultSecrets.Secrets)
+	expiredCh := vaultClient.NotifyExpired()
+	for name, secret := range resultSecrets.Secrets {
+		if err := vaultClient.RenewLease(ctx, name, secret); err != nil {
+			return err
+		}
+	}
+
+	if supervisor != nil {
+		if err := supervisor.Start(); err != nil {
+			return err
+		}
+	}
+	certificates := newCertificateScheduler(logger, vaultClient.Role(), options.CertificateRenewFraction)
+	certificates.schedule(ctx, vaultTemplate.WrittenSecrets())
+	r := &rerenderer{
+		logger:        logger,
+		vaultClient:   vaultClient,
+		vaultTemplate: vaultTemplate,
+		supervisor:    supervisor,
+		hooks:         hooks,
+		certificates:  certificates,
+		pollInterval:  options.PollInterval,
+		done:          make(chan struct{}),
+	}
+	go r.run(ctx, expiredCh)
+
+	err = wait(ctx, vaultClient, supervisor)
+	cancel()
+	// The secrets and outputs are not changed anymore once the rerenderer
+	// stopped
+	<-r.done
+	shutdown(logger, options, vaultClient, vaultTemplate, resultSecrets)
 
-	err = vaultClient.Wait(ctx)
 	// We can safely retry fetching the secret as long as we get empty secret data from vault
 	if err == vault.ErrRenewerNoSecretData {
 		if retries <= options.MaxRetries {
@@ -50,3 +103,61 @@ func Run(logger hclog.Logger, options *Options) error {
 	}
 	return err
 }
+
+// shutdown revokes the secret leases and removes the rendered outputs, if
+// configured.
+func shutdown(logger hclog.Logger, options *Options, vaultClient *vault.Client, vaultTemplate *template.VaultifyTemplate, resultSecrets *secrets.Secrets) {
+	if options.DeleteOutputsOnShutdown {
+		if err := vaultTemplate.RemoveOutputs(); err != nil {
+			logger.Error("failed to remove output files", "error", err)
+		}
+	}
+
+	if options.RevokeOnShutdown {
+		if err := vaultClient.RevokeLeases(resultSecrets.Secrets); err != nil {
+			logger.Error("failed to revoke secret leases", "error", err)
+		}
+		if vaultClient.ExternalAuthToken() {
+			logger.Info("not revoking the auth token supplied to vaultify")
+		} else if err := vaultClient.RevokeAuthToken(); err != nil {
+			logger.Error("failed to revoke auth token", "error", err)
+		}
+	}
+}
+
+func newSupervisor(logger hclog.Logger, options *Options) (*process.Supervisor, error) {
+	if len(options.Command) == 0 {
+		return nil, nil
+	}
+
+	var reloadSignal os.Signal
+	if options.ReloadSignal != "" {
+		sig, err := process.ParseSignal(options.ReloadSignal)
+		if err != nil {
+			return nil, err
+		}
+		reloadSignal = sig
+	}
+	return process.NewSupervisor(logger, options.Command, options.RestartOnRender, reloadSignal), nil
+}
+
+// wait waits until the vault client is done, or the supervised process exited.
+// The process is stopped when the vault client is done.
+func wait(ctx context.Context, vaultClient *vault.Client, supervisor *process.Supervisor) error {
+	if supervisor == nil {
+		return vaultClient.Wait(ctx)
+	}
+
+	vaultDoneCh := make(chan error, 1)
+	go func() {
+		vaultDoneCh <- vaultClient.Wait(ctx)
+	}()
+
+	select {
+	case err := <-supervisor.DoneCh():
+		return err
+	case err := <-vaultDoneCh:
+		supervisor.Stop()
+		return err
+	}
+}
@@ -0,0 +1,104 @@
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// KeyEnv is the environment variable holding the secrets file key, if no key
+// file is given.
+const KeyEnv = "VAULTIFY_SECRETS_KEY"
+
+const encryptionAESGCM = "aes-256-gcm"
+
+var ErrKeyRequired = errors.New("secrets file is encrypted, a key is required")
+
+// ErrNotEncrypted is returned for a plain secrets file when a key is given, it
+// could have been replaced by anyone able to write it.
+var ErrNotEncrypted = errors.New("secrets file is not encrypted, but a key is given")
+
+// encryptedFile is the content of an encrypted secrets file.
+type encryptedFile struct {
+	Encryption string
+	Nonce      []byte
+	Ciphertext []byte
+}
+
+// ReadKey reads the base64 encoded 256 bit key to encrypt the secrets file
+// with from keyFile, or from VAULTIFY_SECRETS_KEY if no file is given.
+// Returns nil if neither is set, the secrets file is not encrypted then.
+func ReadKey(keyFile string) ([]byte, error) {
+	encoded := os.Getenv(KeyEnv)
+	if keyFile != "" {
+		content, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		encoded = string(content)
+	}
+	encoded = strings.TrimSpace(encoded)
+	if encoded == "" {
+		return nil, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid secrets key, expected base64: %v", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("invalid secrets key, expected 32 bytes, got %d", len(key))
+	}
+	return key, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func encrypt(key []byte, plaintext []byte) (*encryptedFile, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return &encryptedFile{
+		Encryption: encryptionAESGCM,
+		Nonce:      nonce,
+		Ciphertext: gcm.Seal(nil, nonce, plaintext, nil),
+	}, nil
+}
+
+func decrypt(key []byte, file *encryptedFile) ([]byte, error) {
+	if file.Encryption != encryptionAESGCM {
+		return nil, fmt.Errorf("unsupported secrets file encryption '%s'", file.Encryption)
+	}
+	if key == nil {
+		return nil, ErrKeyRequired
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := gcm.Open(nil, file.Nonce, file.Ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt secrets file, wrong key? %v", err)
+	}
+	return plaintext, nil
+}
@@ -16,7 +16,13 @@ func NewMapReader(values MapSecrets) *MapSecretReader {
 	}
 }
 
-func (reader *MapSecretReader) Get(name string) (*Secret, error) {
+func (reader *MapSecretReader) Get(name string, params map[string][]string) (*Secret, error) {
+	if value, ok := reader.values[Key(name, params)]; ok {
+		return &Secret{
+			Renewable: false,
+			Data:      value,
+		}, nil
+	}
 	if value, ok := reader.values[name]; ok {
 		return &Secret{
 			Renewable: false,
@@ -27,6 +33,24 @@ func (reader *MapSecretReader) Get(name string) (*Secret, error) {
 	return nil, fmt.Errorf("unknown key '%s'", name)
 }
 
+// GetMetadata returns the value of "<name>#metadata".
+func (reader *MapSecretReader) GetMetadata(name string) (*Secret, error) {
+	return reader.Get(name+"#metadata", nil)
+}
+
+// Write returns the value like Get, with the data as parameters.
+func (reader *MapSecretReader) Write(name string, data map[string]interface{}) (*Secret, error) {
+	params := map[string][]string{}
+	for key, value := range data {
+		if values, ok := value.([]string); ok {
+			params[key] = values
+		} else {
+			params[key] = []string{fmt.Sprint(value)}
+		}
+	}
+	return reader.Get(name, params)
+}
+
 func (reader *MapSecretReader) GetAuthSecret() *Secret {
 	return nil
 }
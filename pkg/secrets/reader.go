@@ -2,8 +2,13 @@ package secrets
 
 import (
 	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"time"
+
 	"github.com/hashicorp/vault/api"
-	"os"
+
+	"github.com/ahilsend/vaultify/pkg/fileutil"
 )
 
 type Value map[string]interface{}
@@ -11,33 +16,114 @@ type Secret = api.Secret
 type Secrets struct {
 	AuthSecret *Secret
 	Secrets    map[string]Secret
+
+	// Expiry of the auth token and the secret leases at their last renewal
+	AuthExpiry  *time.Time           `json:",omitempty"`
+	LeaseExpiry map[string]time.Time `json:",omitempty"`
+
+	// The auth token was supplied to vaultify, e.g. with the token auth
+	// method, instead of obtained by logging in. It is never revoked.
+	ExternalAuthToken bool `json:",omitempty"`
 }
 
 type SecretReader interface {
-	Get(name string) (*Secret, error)
+	// Get reads a secret, optionally with parameters like the version of a
+	// KV version 2 secret. KV version 2 secrets are returned with the secret
+	// data, without the nested metadata.
+	Get(name string, params map[string][]string) (*Secret, error)
+	// GetMetadata reads the metadata of a KV version 2 secret.
+	GetMetadata(name string) (*Secret, error)
+	// Write writes to a secret engine that returns a secret, like issuing a
+	// PKI certificate.
+	Write(name string, data map[string]interface{}) (*Secret, error)
 	GetAuthSecret() *Secret
 }
 
-func Write(filePath string, secrets *Secrets) error {
-	file, err := os.Create(filePath)
+// Key returns the key to store a secret read with parameters by.
+func Key(name string, params map[string][]string) string {
+	if len(params) == 0 {
+		return name
+	}
+	return name + "?" + url.Values(params).Encode()
+}
+
+// UpdateAuth replaces the auth secret with a renewed or new auth token.
+func (s *Secrets) UpdateAuth(renewed *Secret, now time.Time) {
+	if renewed == nil || renewed.Auth == nil {
+		return
+	}
+
+	s.AuthSecret = renewed
+	expiry := now.Add(time.Duration(renewed.Auth.LeaseDuration) * time.Second)
+	s.AuthExpiry = &expiry
+}
+
+// UpdateLease updates the lease of a secret after it was renewed. The secret
+// data is kept, as renewals don't return it. Returns false for unknown
+// secrets.
+func (s *Secrets) UpdateLease(name string, renewed *Secret, now time.Time) bool {
+	secret, ok := s.Secrets[name]
+	if !ok || renewed == nil {
+		return false
+	}
+
+	if renewed.LeaseID != "" {
+		secret.LeaseID = renewed.LeaseID
+	}
+	secret.LeaseDuration = renewed.LeaseDuration
+	secret.Renewable = renewed.Renewable
+	s.Secrets[name] = secret
+
+	if s.LeaseExpiry == nil {
+		s.LeaseExpiry = map[string]time.Time{}
+	}
+	s.LeaseExpiry[name] = now.Add(time.Duration(renewed.LeaseDuration) * time.Second)
+	return true
+}
+
+// Write writes the lease state of the secrets to a file, encrypted if a key is
+// given. The secret data is not written.
+func Write(filePath string, secrets *Secrets, key []byte) error {
+	data, err := json.Marshal(newLeaseState(secrets))
 	if err != nil {
 		return err
 	}
 
-	file.Chmod(0600)
-	return json.NewEncoder(file).Encode(secrets)
+	if key != nil {
+		encrypted, err := encrypt(key, data)
+		if err != nil {
+			return err
+		}
+		data, err = json.Marshal(encrypted)
+		if err != nil {
+			return err
+		}
+	}
+
+	return fileutil.WriteAtomic(filePath, append(data, '\n'), 0600)
 }
 
-func Read(filePath string) (*Secrets, error) {
-	file, err := os.Open(filePath)
+// Read reads the secrets from a file, and decrypts them if the file is
+// encrypted. Files with the full secrets written by previous versions are
+// read as well.
+func Read(filePath string, key []byte) (*Secrets, error) {
+	data, err := ioutil.ReadFile(filePath)
 	if err != nil {
 		return nil, err
 	}
 
-	var secrets Secrets
-	err = json.NewDecoder(file).Decode(&secrets)
-	if err != nil {
+	var encrypted encryptedFile
+	if err := json.Unmarshal(data, &encrypted); err != nil {
 		return nil, err
 	}
-	return &secrets, err
+	if encrypted.Ciphertext != nil {
+		data, err = decrypt(key, &encrypted)
+		if err != nil {
+			return nil, err
+		}
+	} else if key != nil {
+		return nil, ErrNotEncrypted
+	}
+
+	return decodeSecrets(data)
 }
@@ -0,0 +1,226 @@
+package secrets
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+func TestUpdateLease(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	now := time.Unix(1500000000, 0).UTC()
+	state := &Secrets{
+		AuthSecret: &Secret{Auth: &api.SecretAuth{ClientToken: "token", LeaseDuration: 60}},
+		Secrets: map[string]Secret{
+			"database/creds/app": {
+				LeaseID:       "database/creds/app/1",
+				LeaseDuration: 60,
+				Renewable:     true,
+				Data:          map[string]interface{}{"username": "app"},
+			},
+		},
+	}
+
+	if state.UpdateLease("database/creds/other", &Secret{LeaseDuration: 3600}, now) {
+		t.Error("expected unknown secret not to be updated")
+	}
+	if !state.UpdateLease("database/creds/app", &Secret{LeaseID: "database/creds/app/1", LeaseDuration: 3600, Renewable: true}, now) {
+		t.Fatal("expected secret to be updated")
+	}
+	state.UpdateAuth(&Secret{Auth: &api.SecretAuth{ClientToken: "token", LeaseDuration: 7200}}, now)
+
+	fileName := path.Join(tmpDir, "secrets.json")
+	if err := Write(fileName, state, nil); err != nil {
+		t.Fatal(err)
+	}
+	actual, err := Read(fileName, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret := actual.Secrets["database/creds/app"]
+	if secret.LeaseDuration != 3600 || secret.LeaseID != "database/creds/app/1" || secret.Data != nil {
+		t.Errorf("expected renewed lease without data, got %v", secret)
+	}
+	if expiry := actual.LeaseExpiry["database/creds/app"]; !expiry.Equal(now.Add(time.Hour)) {
+		t.Errorf("expected lease to expire at %v, got %v", now.Add(time.Hour), expiry)
+	}
+	if actual.AuthSecret.Auth.LeaseDuration != 7200 || actual.AuthExpiry == nil || !actual.AuthExpiry.Equal(now.Add(2*time.Hour)) {
+		t.Errorf("expected renewed auth token expiring at %v, got %v", now.Add(2*time.Hour), actual.AuthExpiry)
+	}
+}
+
+func TestWriteEncrypted(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := path.Join(tmpDir, "key")
+	if err := ioutil.WriteFile(keyFile, []byte(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	key, err := ReadKey(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state := &Secrets{
+		AuthSecret: &Secret{Auth: &api.SecretAuth{ClientToken: "token"}},
+		Secrets: map[string]Secret{
+			"database/creds/app": {
+				LeaseID: "database/creds/app/1",
+				Data:    map[string]interface{}{"password": "secret-password"},
+			},
+		},
+	}
+
+	fileName := path.Join(tmpDir, "secrets.json")
+	if err := Write(fileName, state, key); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(content, []byte("token")) || bytes.Contains(content, []byte("database/creds/app")) {
+		t.Errorf("expected encrypted secrets file, got %s", content)
+	}
+
+	if _, err := Read(fileName, nil); err != ErrKeyRequired {
+		t.Errorf("expected %v without key, got %v", ErrKeyRequired, err)
+	}
+	if _, err := Read(fileName, bytes.Repeat([]byte{2}, 32)); err == nil {
+		t.Error("expected error with wrong key")
+	}
+	actual, err := Read(fileName, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual.AuthSecret.Auth.ClientToken != "token" || actual.Secrets["database/creds/app"].LeaseID != "database/creds/app/1" {
+		t.Errorf("expected decrypted secrets, got %v", actual)
+	}
+
+	// A plain file replacing the encrypted one is rejected
+	if err := Write(fileName, state, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Read(fileName, key); err != ErrNotEncrypted {
+		t.Errorf("expected %v for a plain file, got %v", ErrNotEncrypted, err)
+	}
+}
+
+func TestReadLegacy(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	legacy := `{"AuthSecret":{"request_id":"","lease_id":"","lease_duration":0,"renewable":false,"data":null,"warnings":null,"auth":{"client_token":"token","accessor":"","policies":null,"token_policies":null,"metadata":{"role":"app"},"lease_duration":3600,"renewable":true,"entity_id":""}},` +
+		`"Secrets":{"database/creds/app":{"request_id":"","lease_id":"database/creds/app/1","lease_duration":60,"renewable":true,"data":{"password":"secret-password"},"warnings":null}}}`
+	fileName := path.Join(tmpDir, "secrets.json")
+	if err := ioutil.WriteFile(fileName, []byte(legacy), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	actual, err := Read(fileName, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual.AuthSecret.Auth.ClientToken != "token" || actual.AuthSecret.Auth.Metadata["role"] != "app" {
+		t.Errorf("expected auth token from legacy file, got %v", actual.AuthSecret.Auth)
+	}
+	if secret := actual.Secrets["database/creds/app"]; secret.LeaseID != "database/creds/app/1" || secret.LeaseDuration != 60 {
+		t.Errorf("expected lease from legacy file, got %v", secret)
+	}
+
+	// Written again in the lease state format, without the secret data
+	if err := Write(fileName, actual, nil); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(content, []byte(`"version":1`)) || bytes.Contains(content, []byte("secret-password")) {
+		t.Errorf("expected lease state without secret data, got %s", content)
+	}
+
+	if err := ioutil.WriteFile(fileName, []byte(`{"version":99}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Read(fileName, nil); err == nil {
+		t.Error("expected error for unsupported version")
+	}
+}
+
+func TestWriteWrappedAuthToken(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	created := time.Unix(1500000000, 0).UTC()
+	state := &Secrets{
+		AuthSecret: &Secret{WrapInfo: &api.SecretWrapInfo{Token: "wrapping-token", TTL: 300, CreationTime: created}},
+		Secrets:    map[string]Secret{},
+	}
+
+	fileName := path.Join(tmpDir, "secrets.json")
+	if err := Write(fileName, state, nil); err != nil {
+		t.Fatal(err)
+	}
+	actual, err := Read(fileName, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if actual.AuthSecret.Auth != nil {
+		t.Errorf("expected no client token, got %v", actual.AuthSecret.Auth)
+	}
+	wrapInfo := actual.AuthSecret.WrapInfo
+	if wrapInfo == nil || wrapInfo.Token != "wrapping-token" || wrapInfo.TTL != 300 || !wrapInfo.CreationTime.Equal(created) {
+		t.Errorf("expected wrapping token, got %v", wrapInfo)
+	}
+}
+
+func TestWriteExternalAuthToken(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	fileName := path.Join(tmpDir, "secrets.json")
+	for _, external := range []bool{true, false} {
+		state := &Secrets{
+			AuthSecret:        &Secret{Auth: &api.SecretAuth{ClientToken: "token"}},
+			Secrets:           map[string]Secret{},
+			ExternalAuthToken: external,
+		}
+		if err := Write(fileName, state, nil); err != nil {
+			t.Fatal(err)
+		}
+		actual, err := Read(fileName, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual.ExternalAuthToken != external {
+			t.Errorf("expected external auth token %v, got %v", external, actual.ExternalAuthToken)
+		}
+	}
+}
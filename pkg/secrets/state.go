@@ -0,0 +1,172 @@
+package secrets
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// StateVersion is the version of the lease state format written to the
+// secrets file. Files without a version contain the full secrets.
+const StateVersion = 1
+
+// leaseState is the content of the secrets file. It contains only what is
+// needed to renew the leases, without the secret data.
+type leaseState struct {
+	Version int                   `json:"version"`
+	Auth    *authState            `json:"auth,omitempty"`
+	Leases  map[string]leaseEntry `json:"leases"`
+}
+
+type authState struct {
+	ClientToken   string            `json:"client_token,omitempty"`
+	Accessor      string            `json:"accessor,omitempty"`
+	Policies      []string          `json:"policies,omitempty"`
+	Metadata      map[string]string `json:"metadata,omitempty"`
+	LeaseDuration int               `json:"lease_duration"`
+	Renewable     bool              `json:"renewable"`
+	Expiry        *time.Time        `json:"expiry,omitempty"`
+
+	// Supplied to vaultify instead of obtained by logging in
+	External bool `json:"external,omitempty"`
+
+	// Response wrapping token of the auth token, instead of the client token
+	WrappingToken        string     `json:"wrapping_token,omitempty"`
+	WrappingTTL          int        `json:"wrapping_ttl,omitempty"`
+	WrappingCreationTime *time.Time `json:"wrapping_creation_time,omitempty"`
+}
+
+type leaseEntry struct {
+	LeaseID       string     `json:"lease_id"`
+	LeaseDuration int        `json:"lease_duration"`
+	Renewable     bool       `json:"renewable"`
+	Expiry        *time.Time `json:"expiry,omitempty"`
+}
+
+// newLeaseState returns the lease state of the secrets. Secrets without a
+// lease are left out.
+func newLeaseState(secrets *Secrets) *leaseState {
+	state := &leaseState{
+		Version: StateVersion,
+		Leases:  map[string]leaseEntry{},
+	}
+
+	if secrets.AuthSecret != nil && secrets.AuthSecret.Auth != nil {
+		auth := secrets.AuthSecret.Auth
+		state.Auth = &authState{
+			ClientToken:   auth.ClientToken,
+			Accessor:      auth.Accessor,
+			Policies:      auth.Policies,
+			Metadata:      auth.Metadata,
+			LeaseDuration: auth.LeaseDuration,
+			Renewable:     auth.Renewable,
+			Expiry:        secrets.AuthExpiry,
+			External:      secrets.ExternalAuthToken,
+		}
+	} else if secrets.AuthSecret != nil && secrets.AuthSecret.WrapInfo != nil {
+		wrapInfo := secrets.AuthSecret.WrapInfo
+		state.Auth = &authState{
+			WrappingToken:        wrapInfo.Token,
+			WrappingTTL:          wrapInfo.TTL,
+			WrappingCreationTime: &wrapInfo.CreationTime,
+			External:             secrets.ExternalAuthToken,
+		}
+	}
+
+	for name, secret := range secrets.Secrets {
+		if secret.LeaseID == "" {
+			continue
+		}
+		entry := leaseEntry{
+			LeaseID:       secret.LeaseID,
+			LeaseDuration: secret.LeaseDuration,
+			Renewable:     secret.Renewable,
+		}
+		if expiry, ok := secrets.LeaseExpiry[name]; ok {
+			entry.Expiry = &expiry
+		}
+		state.Leases[name] = entry
+	}
+	return state
+}
+
+// secrets returns the secrets of the lease state, without secret data.
+func (state *leaseState) secrets() *Secrets {
+	secrets := &Secrets{
+		Secrets: map[string]Secret{},
+	}
+
+	if state.Auth != nil && state.Auth.WrappingToken != "" {
+		wrapInfo := &api.SecretWrapInfo{
+			Token: state.Auth.WrappingToken,
+			TTL:   state.Auth.WrappingTTL,
+		}
+		if state.Auth.WrappingCreationTime != nil {
+			wrapInfo.CreationTime = *state.Auth.WrappingCreationTime
+		}
+		secrets.AuthSecret = &Secret{WrapInfo: wrapInfo}
+	} else if state.Auth != nil {
+		secrets.AuthSecret = &Secret{
+			Auth: &api.SecretAuth{
+				ClientToken:   state.Auth.ClientToken,
+				Accessor:      state.Auth.Accessor,
+				Policies:      state.Auth.Policies,
+				Metadata:      state.Auth.Metadata,
+				LeaseDuration: state.Auth.LeaseDuration,
+				Renewable:     state.Auth.Renewable,
+			},
+		}
+		secrets.AuthExpiry = state.Auth.Expiry
+	}
+
+	if state.Auth != nil {
+		secrets.ExternalAuthToken = state.Auth.External
+	}
+
+	for name, entry := range state.Leases {
+		secrets.Secrets[name] = Secret{
+			LeaseID:       entry.LeaseID,
+			LeaseDuration: entry.LeaseDuration,
+			Renewable:     entry.Renewable,
+		}
+		if entry.Expiry != nil {
+			if secrets.LeaseExpiry == nil {
+				secrets.LeaseExpiry = map[string]time.Time{}
+			}
+			secrets.LeaseExpiry[name] = *entry.Expiry
+		}
+	}
+	return secrets
+}
+
+// decodeSecrets decodes the lease state, or the full secrets written by
+// previous versions.
+func decodeSecrets(data []byte) (*Secrets, error) {
+	var versioned struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(data, &versioned); err != nil {
+		return nil, err
+	}
+
+	switch versioned.Version {
+	case 0:
+		var secrets Secrets
+		if err := json.Unmarshal(data, &secrets); err != nil {
+			return nil, err
+		}
+		return &secrets, nil
+
+	case StateVersion:
+		var state leaseState
+		if err := json.Unmarshal(data, &state); err != nil {
+			return nil, err
+		}
+		return state.secrets(), nil
+
+	default:
+		return nil, fmt.Errorf("unsupported secrets file version %d", versioned.Version)
+	}
+}
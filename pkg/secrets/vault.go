@@ -1,28 +1,136 @@
 package secrets
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/ahilsend/vaultify/pkg/vault"
 )
 
 type VaultSecretReader struct {
 	vaultClient *vault.Client
+	// Mounts of the looked up secrets, by secret name. Mounts can be nested,
+	// so the mount of a parent path does not apply to all secrets below it.
+	mounts map[string]mount
+}
+
+// mount is the mount path of a secret, and whether it is a KV version 2
+// mount. The path is empty if the mount is not known.
+type mount struct {
+	path string
+	kvV2 bool
 }
 
 func NewVaultReader(vaultClient *vault.Client) *VaultSecretReader {
 	return &VaultSecretReader{
 		vaultClient: vaultClient,
+		mounts:      map[string]mount{},
 	}
 }
 
-func (reader *VaultSecretReader) Get(name string) (*Secret, error) {
-	secret, err := reader.vaultClient.ApiClient.Logical().Read(name)
+func (reader *VaultSecretReader) Get(name string, params map[string][]string) (*Secret, error) {
+	mount, path, err := reader.kvV2Path(name)
 	if err != nil {
 		return nil, err
 	}
 
+	if mount == "" {
+		return reader.vaultClient.ApiClient.Logical().ReadWithData(name, params)
+	}
+
+	secret, err := reader.vaultClient.ApiClient.Logical().ReadWithData(mount+"data/"+path, params)
+	if err != nil || secret == nil {
+		return secret, err
+	}
+
+	// Deleted and destroyed versions have no data
+	data, ok := secret.Data["data"].(map[string]interface{})
+	if !ok {
+		return nil, nil
+	}
+	secret.Data = data
 	return secret, nil
 }
 
+func (reader *VaultSecretReader) GetMetadata(name string) (*Secret, error) {
+	mount, path, err := reader.kvV2Path(name)
+	if err != nil {
+		return nil, err
+	}
+	if mount == "" {
+		return nil, fmt.Errorf("'%s' is not on a KV version 2 mount", name)
+	}
+
+	return reader.vaultClient.ApiClient.Logical().Read(mount + "metadata/" + path)
+}
+
+func (reader *VaultSecretReader) Write(name string, data map[string]interface{}) (*Secret, error) {
+	return reader.vaultClient.ApiClient.Logical().Write(name, data)
+}
+
 func (reader *VaultSecretReader) GetAuthSecret() *Secret {
-	return reader.vaultClient.AuthSecret
+	return reader.vaultClient.AuthSecret()
+}
+
+// kvV2Path splits name into the mount path and the path of the secret within
+// the mount, if name is on a KV version 2 mount. Returns an empty mount path
+// otherwise, or if the name already uses the KV version 2 API paths.
+func (reader *VaultSecretReader) kvV2Path(name string) (string, string, error) {
+	secretMount, ok := reader.mounts[name]
+	if !ok {
+		mountPath, isKVv2, err := reader.lookupMount(name)
+		if err != nil {
+			return "", "", err
+		}
+		secretMount = mount{path: mountPath, kvV2: isKVv2}
+		reader.mounts[name] = secretMount
+	}
+
+	if secretMount.path == "" || !secretMount.kvV2 {
+		return "", "", nil
+	}
+
+	path := strings.TrimPrefix(name, secretMount.path)
+	if strings.HasPrefix(path, "data/") || strings.HasPrefix(path, "metadata/") {
+		return "", "", nil
+	}
+	return secretMount.path, path, nil
+}
+
+// lookupMount returns the mount path of name, including a namespace prefixed
+// to name, and whether it is a KV version 2 mount. Names for which the mount
+// is not found or can't be looked up are handled as not being on a KV version
+// 2 mount, other errors are returned.
+func (reader *VaultSecretReader) lookupMount(name string) (string, bool, error) {
+	secret, err := reader.vaultClient.ApiClient.Logical().Read("sys/internal/ui/mounts/" + name)
+	if err != nil {
+		// The mount can't be looked up with the permissions of older versions
+		// of vault, handle it as a plain secret
+		if strings.Contains(err.Error(), "Code: 403") {
+			return "", false, nil
+		}
+		return "", false, fmt.Errorf("failed to look up mount of '%s': %v", name, err)
+	}
+	// Not found
+	if secret == nil {
+		return "", false, nil
+	}
+
+	mount, _ := secret.Data["path"].(string)
+	if mount == "" {
+		return "", false, nil
+	}
+	// Mount paths are returned relative to the namespace
+	if !strings.HasPrefix(name, mount) {
+		i := strings.Index(name, "/"+mount)
+		if i < 0 {
+			return "", false, nil
+		}
+		mount = name[:i+1] + mount
+	}
+
+	mountType, _ := secret.Data["type"].(string)
+	options, _ := secret.Data["options"].(map[string]interface{})
+	version, _ := options["version"].(string)
+	return mount, mountType == "kv" && version == "2", nil
 }
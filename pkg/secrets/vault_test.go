@@ -0,0 +1,164 @@
+package secrets
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/api"
+
+	"github.com/ahilsend/vaultify/pkg/vault"
+)
+
+var kvMount = `{"data": {"path": "secret/", "type": "kv", "options": {"version": "2"}}}`
+
+// vaultResponses are the responses of the test server, by request path
+var vaultResponses = map[string]string{
+	"/v1/sys/internal/ui/mounts/secret/app":      kvMount,
+	"/v1/sys/internal/ui/mounts/secret/deleted":  kvMount,
+	"/v1/sys/internal/ui/mounts/secret/data/app": kvMount,
+	"/v1/sys/internal/ui/mounts/team-a/kv/app":   `{"data": {"path": "kv/", "type": "kv", "options": {"version": "2"}}}`,
+	"/v1/sys/internal/ui/mounts/kv-v1/app":       `{"data": {"path": "kv-v1/", "type": "kv", "options": {"version": "1"}}}`,
+	"/v1/secret/data/app":                        `{"data": {"data": {"password": "v2"}, "metadata": {"version": 3}}}`,
+	"/v1/secret/data/deleted":                    `{"data": {"data": null, "metadata": {"version": 1, "deletion_time": "2019-01-01T00:00:00Z"}}}`,
+	"/v1/secret/metadata/app":                    `{"data": {"current_version": 3}}`,
+	"/v1/team-a/kv/data/app":                     `{"data": {"data": {"password": "namespace"}, "metadata": {"version": 1}}}`,
+	"/v1/kv-v1/app":                              `{"data": {"password": "v1"}}`,
+	"/v1/denied/app":                             `{"data": {"password": "denied"}}`,
+	"/v1/sys/internal/ui/mounts/denied/app":      "403",
+	"/v1/sys/internal/ui/mounts/unavailable/app": "500",
+	// secret/team/ is a KV version 1 mount nested in secret/
+	"/v1/sys/internal/ui/mounts/secret/x":      kvMount,
+	"/v1/sys/internal/ui/mounts/secret/team/y": `{"data": {"path": "secret/team/", "type": "kv", "options": {"version": "1"}}}`,
+	"/v1/secret/data/x":                        `{"data": {"data": {"password": "parent"}, "metadata": {"version": 1}}}`,
+	"/v1/secret/team/y":                        `{"data": {"password": "nested"}}`,
+}
+
+func newTestVaultReader(t *testing.T) (*VaultSecretReader, func()) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response, ok := vaultResponses[r.URL.Path]
+		switch {
+		case !ok || response == "404":
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors": []}`))
+		case response == "403":
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors": ["permission denied"]}`))
+		case response == "500":
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"errors": ["internal error"]}`))
+		default:
+			w.Write([]byte(response))
+		}
+	}))
+
+	vaultClient, err := vault.NewClientFromSecret(hclog.NewNullLogger(), &api.Secret{Auth: &api.SecretAuth{ClientToken: "token"}}, nil, &vault.Config{
+		Config: &api.Config{Address: server.URL},
+	})
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	vaultClient.ApiClient.SetMaxRetries(0)
+	return NewVaultReader(vaultClient), server.Close
+}
+
+func TestVaultReaderKVv2(t *testing.T) {
+	reader, closeServer := newTestVaultReader(t)
+	defer closeServer()
+
+	tests := []struct {
+		name     string
+		expected map[string]interface{}
+	}{
+		// Read through the data/ API path
+		{"secret/app", map[string]interface{}{"password": "v2"}},
+		// KV version 2 API paths are passed through
+		{"secret/data/app", map[string]interface{}{"data": map[string]interface{}{"password": "v2"}, "metadata": map[string]interface{}{"version": "3"}}},
+		// Mount path relative to the namespace prefixed to the name
+		{"team-a/kv/app", map[string]interface{}{"password": "namespace"}},
+		{"kv-v1/app", map[string]interface{}{"password": "v1"}},
+		// Mounts that can't be looked up are read as plain secrets
+		{"denied/app", map[string]interface{}{"password": "denied"}},
+	}
+
+	for _, test := range tests {
+		secret, err := reader.Get(test.name, nil)
+		if err != nil {
+			t.Fatalf("reading %s failed: %v", test.name, err)
+		}
+		if secret == nil || !reflect.DeepEqual(normalize(secret.Data), normalize(test.expected)) {
+			t.Errorf("expected %s to be %v, got %v", test.name, test.expected, secret)
+		}
+	}
+
+	if mount := reader.mounts["team-a/kv/app"]; mount.path != "team-a/kv/" || !mount.kvV2 {
+		t.Errorf("expected team-a/kv/ to be known as KV version 2 mount, got %v", reader.mounts)
+	}
+
+	// Deleted versions have no data
+	secret, err := reader.Get("secret/deleted", nil)
+	if err != nil || secret != nil {
+		t.Errorf("expected deleted version not to be found, got %v, %v", secret, err)
+	}
+
+	metadata, err := reader.GetMetadata("secret/app")
+	if err != nil || metadata == nil || metadata.Data["current_version"] == nil {
+		t.Errorf("expected metadata of secret/app, got %v, %v", metadata, err)
+	}
+	if _, err := reader.GetMetadata("kv-v1/app"); err == nil {
+		t.Error("expected error reading metadata of a KV version 1 secret")
+	}
+}
+
+func TestVaultReaderLookupMountError(t *testing.T) {
+	reader, closeServer := newTestVaultReader(t)
+	defer closeServer()
+
+	if _, err := reader.Get("unavailable/app", nil); err == nil {
+		t.Error("expected error when the mount can't be looked up")
+	}
+	if _, ok := reader.mounts["unavailable/app"]; ok {
+		t.Error("expected failed mount lookup not to be cached")
+	}
+}
+
+// normalize converts numbers to strings, as JSON numbers are decoded as
+// json.Number.
+func normalize(data map[string]interface{}) map[string]interface{} {
+	normalized := map[string]interface{}{}
+	for key, value := range data {
+		switch value := value.(type) {
+		case map[string]interface{}:
+			normalized[key] = normalize(value)
+		default:
+			normalized[key] = fmt.Sprint(value)
+		}
+	}
+	return normalized
+}
+
+func TestVaultReaderNestedMounts(t *testing.T) {
+	reader, closeServer := newTestVaultReader(t)
+	defer closeServer()
+
+	// The mount of the parent path is known first
+	for _, test := range []struct {
+		name     string
+		expected string
+	}{
+		{"secret/x", "parent"},
+		{"secret/team/y", "nested"},
+	} {
+		secret, err := reader.Get(test.name, nil)
+		if err != nil {
+			t.Fatalf("reading %s failed: %v", test.name, err)
+		}
+		if secret == nil || secret.Data["password"] != test.expected {
+			t.Errorf("expected %s to be %s, got %v", test.name, test.expected, secret)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package template
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/go-hclog"
+
+	"github.com/ahilsend/vaultify/pkg/options"
+	"github.com/ahilsend/vaultify/pkg/process"
+)
+
+// Hooks are run when output files changed, the global hook for all changed
+// output files, and the hook of every template for its own output files.
+type Hooks struct {
+	global    *process.Hook
+	templates []templateHook
+}
+
+type templateHook struct {
+	outputPath string
+	hook       *process.Hook
+}
+
+// NewHooks returns the hooks to run when output files changed, or nil if none
+// is configured.
+func NewHooks(logger hclog.Logger, options options.CommonTemplateOptions) (*Hooks, error) {
+	global, err := newHook(logger, options.HookOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	hooks := &Hooks{global: global}
+	for _, templateConfig := range options.Templates {
+		hook, err := newHook(logger, templateConfig.HookOptions)
+		if err != nil {
+			return nil, err
+		}
+		if hook != nil {
+			hooks.templates = append(hooks.templates, templateHook{
+				outputPath: filepath.Clean(templateConfig.OutputPath),
+				hook:       hook,
+			})
+		}
+	}
+
+	if hooks.global == nil && len(hooks.templates) == 0 {
+		return nil, nil
+	}
+	return hooks, nil
+}
+
+func newHook(logger hclog.Logger, options options.HookOptions) (*process.Hook, error) {
+	return process.NewHook(logger,
+		options.OnChangeCommand,
+		options.OnChangeSignal,
+		options.OnChangePidFile,
+		options.OnChangeProcessName)
+}
+
+// Run runs the hooks of the changed output files. A failing hook does not
+// keep the other hooks from running, the errors of all failed hooks are
+// returned.
+func (h *Hooks) Run(changed []string) error {
+	var failed []string
+	for _, templateHook := range h.templates {
+		var templateChanged []string
+		for _, outputFile := range changed {
+			if templateHook.contains(outputFile) {
+				templateChanged = append(templateChanged, outputFile)
+			}
+		}
+		if len(templateChanged) > 0 {
+			if err := templateHook.hook.Run(templateChanged); err != nil {
+				failed = append(failed, fmt.Sprintf("hook of %s: %v", templateHook.outputPath, err))
+			}
+		}
+	}
+
+	if h.global != nil {
+		if err := h.global.Run(changed); err != nil {
+			failed = append(failed, fmt.Sprintf("global hook: %v", err))
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("%d hooks failed: %s", len(failed), strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// contains returns true if outputFile is the output path of the template, or
+// is in its output directory.
+func (h templateHook) contains(outputFile string) bool {
+	outputFile = filepath.Clean(outputFile)
+	return outputFile == h.outputPath ||
+		strings.HasPrefix(outputFile, h.outputPath+string(filepath.Separator))
+}
+
+// RunHooks runs the hooks if any output file of the template changed.
+func RunHooks(hooks *Hooks, vaultTemplate *VaultifyTemplate) error {
+	changed := vaultTemplate.ChangedOutputs()
+	if hooks == nil || len(changed) == 0 {
+		return nil
+	}
+	return hooks.Run(changed)
+}
@@ -0,0 +1,47 @@
+package template
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+
+	"github.com/ahilsend/vaultify/pkg/options"
+)
+
+func TestHooksRunAll(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	marker := func(name string) string {
+		return "touch " + path.Join(tmpDir, name)
+	}
+	hooks, err := NewHooks(hclog.Default(), options.CommonTemplateOptions{
+		HookOptions: options.HookOptions{OnChangeCommand: marker("global")},
+		Templates: []options.TemplateConfig{
+			{OutputPath: "/output/a.yaml", HookOptions: options.HookOptions{OnChangeCommand: "exit 1"}},
+			{OutputPath: "/output/b.yaml", HookOptions: options.HookOptions{OnChangeCommand: marker("b")}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = hooks.Run([]string{"/output/a.yaml", "/output/b.yaml"})
+	if err == nil || !strings.Contains(err.Error(), "/output/a.yaml") {
+		t.Errorf("expected the failed hook of /output/a.yaml to be reported, got %v", err)
+	}
+
+	// The other hooks run anyway
+	for _, name := range []string{"b", "global"} {
+		if _, err := os.Stat(path.Join(tmpDir, name)); err != nil {
+			t.Errorf("expected hook %s to run, got %v", name, err)
+		}
+	}
+}
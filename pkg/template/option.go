@@ -8,6 +8,7 @@ import (
 type Options struct {
 	options.CommonOptions
 	options.CommonTemplateOptions
+	options.SecretsFileOptions
 
 	// Secrets file location, where the secret leases are stored
 	SecretsOutputFileName string
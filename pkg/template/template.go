@@ -4,16 +4,22 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
 	"text/template"
 
 	"github.com/Masterminds/sprig"
 	"github.com/hashicorp/go-hclog"
 
+	"github.com/ahilsend/vaultify/pkg/fileutil"
 	"github.com/ahilsend/vaultify/pkg/options"
 	"github.com/ahilsend/vaultify/pkg/secrets"
 	"github.com/ahilsend/vaultify/pkg/vault"
@@ -23,15 +29,77 @@ const (
 	templateName = "vaultify"
 )
 
+// permissions are the mode and owner of an output file.
+type permissions struct {
+	// 0 for the mode of the template file if preserveMode is set, or the
+	// default mode
+	mode         os.FileMode
+	preserveMode bool
+	// -1 keeps the owner or group of an existing output file, new ones are
+	// owned by the user of the process
+	uid int
+	gid int
+}
+
+var defaultPermissions = permissions{mode: 0600, uid: -1, gid: -1}
+
+// unconfiguredPermissions are the permissions of outputs rendered without
+// configured permissions, their files get the default permissions.
+var unconfiguredPermissions = permissions{uid: -1, gid: -1}
+
+// delimiters are the action delimiters of a template.
+type delimiters struct {
+	left  string
+	right string
+}
+
+var defaultDelimiters = delimiters{left: "<{", right: "}>"}
+
+// delimitersDirective is a first line of a template setting its delimiters,
+// e.g. "# vaultify: delimiters [[ ]]". The line can be a comment of any
+// syntax, it is not rendered.
+var delimitersDirective = regexp.MustCompile(`^[^\n]*vaultify:[ \t]*delimiters[ \t]+(\S+)[ \t]+(\S+)[^\n]*(\n|$)`)
+
 type VaultifyTemplate struct {
 	secretReader secrets.SecretReader
 	logger       hclog.Logger
 	funcMap      map[string]interface{}
 	secrets      *secrets.Secrets
+
+	// Template file that is currently rendered
+	currentTemplate string
+	// Output files of every rendered template file
+	outputs map[string][]string
+	// Permissions of the output files, by output file
+	permissions map[string]permissions
+	// Permissions of the output files of the template currently rendered by
+	// RenderToPath
+	currentPermissions permissions
+	// File filtering of template directories rendered by RenderToPath
+	currentDirectoryOptions options.DirectoryOptions
+	// Delimiters of the templates rendered by RenderToPath
+	currentDelimiters delimiters
+	// Delimiters of the template files
+	delimiters map[string]delimiters
+	// Modes of the output directories of rendered template directories
+	directories map[string]os.FileMode
+	// Template files using a secret, by secret name
+	dependencies map[string][]string
+	// Output files whose content changed since the last call to ChangedOutputs
+	changedOutputs []string
+	// Functions to read secrets again, that were read with 'vault', by name
+	reads map[string]func() (*secrets.Secret, error)
+	// Names of the secrets written with 'vaultWrite'
+	writes map[string]bool
 }
 
 func Run(logger hclog.Logger, options *Options) error {
-	secretReader, err := createSecretReader(logger, options)
+	secretReader, vaultClient, err := createSecretReader(logger, options)
+	if err != nil {
+		return err
+	}
+
+	hooks, err := NewHooks(logger, options.CommonTemplateOptions)
 	if err != nil {
 		return err
 	}
@@ -42,33 +110,63 @@ func Run(logger hclog.Logger, options *Options) error {
 		return err
 	}
 
+	// The secrets file is written before running the hooks, so the issued
+	// leases are not lost when a hook fails
+	if err := writeSecrets(options, vaultClient, resultSecrets); err != nil {
+		return err
+	}
+
+	if err := RunHooks(hooks, vaultTemplate); err != nil {
+		logger.Error("failed to run hooks", "error", err)
+	}
+	return nil
+}
+
+// writeSecrets writes the secrets to the secrets output file, if configured.
+func writeSecrets(options *Options, vaultClient *vault.Client, resultSecrets *secrets.Secrets) error {
 	if options.SecretsOutputFileName == "" {
 		return nil
 	}
-	return secrets.Write(options.SecretsOutputFileName, resultSecrets)
+	key, err := secrets.ReadKey(options.SecretsKeyFile)
+	if err != nil {
+		return err
+	}
+	if options.SecretsWrapTTL > 0 && vaultClient != nil {
+		wrapped, err := vaultClient.WrapAuthToken(options.SecretsWrapTTL)
+		if err != nil {
+			return err
+		}
+		resultSecrets.AuthSecret = wrapped
+	}
+	if vaultClient != nil {
+		resultSecrets.ExternalAuthToken = vaultClient.ExternalAuthToken()
+	}
+	return secrets.Write(options.SecretsOutputFileName, resultSecrets, key)
 }
 
-func createSecretReader(logger hclog.Logger, options *Options) (secrets.SecretReader, error) {
+// createSecretReader returns the secret reader, and the vault client it uses.
+// The client is nil when variables are used instead of vault.
+func createSecretReader(logger hclog.Logger, options *Options) (secrets.SecretReader, *vault.Client, error) {
 	if len(options.Variables) > 0 {
 		values := secrets.MapSecrets{}
 		for name, jsonString := range options.Variables {
 			var secret secrets.Value
 			err := json.Unmarshal([]byte(jsonString), &secret)
 			if err != nil {
-				return nil, err
+				return nil, nil, err
 			}
 			values[name] = secret
 		}
-		return secrets.NewMapReader(values), nil
+		return secrets.NewMapReader(values), nil, nil
 	}
 
-	config := options.VaultApiConfig()
-	vaultClient, err := vault.NewClient(logger, options.Role, config)
+	config := options.VaultConfig()
+	vaultClient, err := vault.NewClient(logger, options.VaultAuthConfig(), config)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return secrets.NewVaultReader(vaultClient), nil
+	return secrets.NewVaultReader(vaultClient), vaultClient, nil
 }
 
 func New(logger hclog.Logger, secretReader secrets.SecretReader) *VaultifyTemplate {
@@ -80,71 +178,385 @@ func New(logger hclog.Logger, secretReader secrets.SecretReader) *VaultifyTempla
 			AuthSecret: secretReader.GetAuthSecret(),
 			Secrets:    map[string]secrets.Secret{},
 		},
+		outputs:            map[string][]string{},
+		permissions:        map[string]permissions{},
+		currentPermissions: unconfiguredPermissions,
+		currentDelimiters:  defaultDelimiters,
+		delimiters:         map[string]delimiters{},
+		directories:        map[string]os.FileMode{},
+		dependencies:       map[string][]string{},
+		reads:              map[string]func() (*secrets.Secret, error){},
+		writes:             map[string]bool{},
 	}
 
 	t.funcMap["vault"] = t.getVaultSecret
+	t.funcMap["vaultNS"] = t.getVaultSecretInNamespace
+	t.funcMap["vaultMetadata"] = t.getVaultMetadata
+	t.funcMap["vaultWrite"] = t.writeVaultSecret
 	return t
 }
 
-func (t *VaultifyTemplate) getVaultSecret(name string) (*secrets.Secret, error) {
+// getVaultSecret reads a secret. Parameters are passed as "key=value", e.g.
+// "version=3" to read a specific version of a KV version 2 secret.
+func (t *VaultifyTemplate) getVaultSecret(name string, params ...string) (*secrets.Secret, error) {
 	if name == "" {
 		return nil, errors.New("you need to pass a name to the 'vault' function")
 	}
 
-	secret, err := t.secretReader.Get(name)
+	values, err := parseParams(params)
+	if err != nil {
+		return nil, err
+	}
+	key := secrets.Key(name, values)
+	read := func() (*secrets.Secret, error) {
+		return t.secretReader.Get(name, values)
+	}
+	t.reads[key] = read
+	return t.fetchSecret(key, read)
+}
+
+// writeVaultSecret writes to a secret engine returning a secret, e.g.
+// vaultWrite "pki/issue/web" "common_name=app.example.com" "ttl=24h".
+// Parameters are passed as "key=value".
+func (t *VaultifyTemplate) writeVaultSecret(name string, params ...string) (*secrets.Secret, error) {
+	if name == "" {
+		return nil, errors.New("you need to pass a name to the 'vaultWrite' function")
+	}
+
+	values, err := parseParams(params)
+	if err != nil {
+		return nil, err
+	}
+	data := map[string]interface{}{}
+	for key, value := range values {
+		if len(value) == 1 {
+			data[key] = value[0]
+		} else {
+			data[key] = value
+		}
+	}
+	key := secrets.Key(name, values)
+	t.writes[key] = true
+	return t.fetchSecret(key, func() (*secrets.Secret, error) {
+		return t.secretReader.Write(name, data)
+	})
+}
+
+// fetchSecret fetches a secret, and tracks it by key. A secret is fetched only
+// once, so every key yields a single lease across all rendered templates.
+func (t *VaultifyTemplate) fetchSecret(key string, fetch func() (*secrets.Secret, error)) (*secrets.Secret, error) {
+	t.addDependency(key)
+	if secret, ok := t.secrets.Secrets[key]; ok {
+		return &secret, nil
+	}
+
+	secret, err := fetch()
 	if err != nil {
 		return nil, err
 	}
-	t.secrets.Secrets[name] = *secret
+	if secret == nil {
+		return nil, fmt.Errorf("secret '%s' not found", key)
+	}
+	t.secrets.Secrets[key] = *secret
 	return secret, err
 }
 
-func (t *VaultifyTemplate) RenderToPath(options options.CommonTemplateOptions) (*secrets.Secrets, error) {
-	file, err := os.Stat(options.TemplatePath)
+// getVaultMetadata reads the metadata of a KV version 2 secret, like its
+// versions.
+func (t *VaultifyTemplate) getVaultMetadata(name string) (*secrets.Secret, error) {
+	if name == "" {
+		return nil, errors.New("you need to pass a name to the 'vaultMetadata' function")
+	}
+
+	secret, err := t.secretReader.GetMetadata(name)
 	if err != nil {
 		return nil, err
 	}
+	if secret == nil {
+		return nil, fmt.Errorf("metadata of secret '%s' not found", name)
+	}
+	return secret, nil
+}
+
+// getVaultSecretInNamespace reads a secret from a namespace relative to the
+// configured namespace (Vault Enterprise). Vault resolves namespaces prefixed
+// to the path, so the secret is tracked by its prefixed path, which is also
+// used to read it again.
+func (t *VaultifyTemplate) getVaultSecretInNamespace(namespace string, name string, params ...string) (*secrets.Secret, error) {
+	if namespace == "" {
+		return nil, errors.New("you need to pass a namespace to the 'vaultNS' function")
+	}
+	if name == "" {
+		return nil, errors.New("you need to pass a name to the 'vaultNS' function")
+	}
+	return t.getVaultSecret(strings.Trim(namespace, "/")+"/"+name, params...)
+}
+
+func (t *VaultifyTemplate) addDependency(name string) {
+	if t.currentTemplate == "" || contains(t.dependencies[name], t.currentTemplate) {
+		return
+	}
+	t.dependencies[name] = append(t.dependencies[name], t.currentTemplate)
+}
+
+// RenderToPath renders all templates of the options, sharing the read secrets
+// between them.
+func (t *VaultifyTemplate) RenderToPath(templateOptions options.CommonTemplateOptions) (*secrets.Secrets, error) {
+	for _, templateConfig := range templateOptions.TemplateConfigs() {
+		t.currentPermissions = permissions{
+			mode:         templateConfig.Mode,
+			preserveMode: templateConfig.PreserveMode,
+			uid:          templateConfig.Uid,
+			gid:          templateConfig.Gid,
+		}
+		t.currentDirectoryOptions = templateConfig.DirectoryOptions
+		t.currentDelimiters = defaultDelimiters
+		if templateConfig.LeftDelimiter != "" {
+			t.currentDelimiters = delimiters{left: templateConfig.LeftDelimiter, right: templateConfig.RightDelimiter}
+		}
+
+		err := t.renderPath(templateConfig.TemplatePath, templateConfig.OutputPath)
+		t.currentPermissions = unconfiguredPermissions
+		t.currentDirectoryOptions = options.DirectoryOptions{}
+		t.currentDelimiters = defaultDelimiters
+		if err != nil {
+			return nil, err
+		}
+	}
+	return t.secrets, nil
+}
+
+// renderPath renders a template file, or all files of a template directory.
+func (t *VaultifyTemplate) renderPath(templatePath string, outputPath string) error {
+	file, err := os.Stat(templatePath)
+	if err != nil {
+		return err
+	}
 
 	if file.Mode().IsRegular() {
-		return t.RenderToFile(options.TemplatePath, options.OutputPath)
+		_, err = t.RenderToFile(templatePath, outputPath)
+		return err
 	} else if file.Mode().IsDir() {
-		return t.RenderToDirectory(options.TemplatePath, options.OutputPath)
+		_, err = t.RenderToDirectory(templatePath, outputPath)
+		return err
 	}
-	return nil, errors.New("Path is not a file or a directory")
+	return errors.New("Path is not a file or a directory")
 }
 
 func (t *VaultifyTemplate) RenderToFile(templateFile string, outputFile string) (*secrets.Secrets, error) {
 	t.logger.Info("Rendering template", "template", templateFile)
-	templateBytes, err := ioutil.ReadFile(templateFile)
+	if !contains(t.outputs[templateFile], outputFile) {
+		t.outputs[templateFile] = append(t.outputs[templateFile], outputFile)
+	}
+	perm, err := t.outputPermissions(templateFile)
 	if err != nil {
 		return nil, err
 	}
+	t.permissions[outputFile] = perm
+	t.delimiters[templateFile] = t.currentDelimiters
 
-	var output io.Writer
-	if outputFile == "" {
-		output = os.Stdout
-	} else {
-		file, err := os.Create(outputFile)
+	output := new(bytes.Buffer)
+	err = t.renderTemplate(templateFile, output)
+	if err != nil {
+		t.logger.Error("Error during rendering", "error", err)
+		return nil, err
+	}
+
+	if err := t.writeOutput(outputFile, output.Bytes()); err != nil {
+		t.logger.Error("Failed to write output file", "outputFile", outputFile, "error", err)
+		return nil, err
+	}
+	return t.secrets, nil
+}
+
+// copyToFile copies a file that is not a template verbatim to outputFile.
+func (t *VaultifyTemplate) copyToFile(file string, outputFile string) error {
+	t.logger.Info("Copying file", "file", file)
+	if !contains(t.outputs[file], outputFile) {
+		t.outputs[file] = append(t.outputs[file], outputFile)
+	}
+	perm, err := t.outputPermissions(file)
+	if err != nil {
+		return err
+	}
+	t.permissions[outputFile] = perm
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if err := t.writeOutput(outputFile, data); err != nil {
+		t.logger.Error("Failed to write output file", "outputFile", outputFile, "error", err)
+		return err
+	}
+	return nil
+}
+
+// outputPermissions returns the permissions of the output files of a template
+// file, rendered with the current permissions.
+func (t *VaultifyTemplate) outputPermissions(templateFile string) (permissions, error) {
+	perm := t.currentPermissions
+	if perm.mode != 0 {
+		return perm, nil
+	}
+
+	perm.mode = defaultPermissions.mode
+	if perm.preserveMode {
+		info, err := os.Stat(templateFile)
+		if err != nil {
+			return perm, err
+		}
+		perm.mode = info.Mode().Perm()
+	}
+	return perm, nil
+}
+
+// WrittenSecrets returns the current secrets written with 'vaultWrite', like
+// issued certificates.
+func (t *VaultifyTemplate) WrittenSecrets() map[string]secrets.Secret {
+	written := map[string]secrets.Secret{}
+	for name := range t.writes {
+		if secret, ok := t.secrets.Secrets[name]; ok {
+			written[name] = secret
+		}
+	}
+	return written
+}
+
+// ChangedOutputs returns the output files whose content changed by rendering
+// since the last call.
+func (t *VaultifyTemplate) ChangedOutputs() []string {
+	changed := t.changedOutputs
+	t.changedOutputs = nil
+	return changed
+}
+
+// Rerender reads the given secrets again, and renders all templates using
+// them to their previous output files. Other secrets used by these templates
+// are not read again. Outputs are only replaced once all templates rendered
+// successfully. Returns all secrets that have been read again.
+func (t *VaultifyTemplate) Rerender(names ...string) (map[string]secrets.Secret, error) {
+	for _, name := range names {
+		delete(t.secrets.Secrets, name)
+	}
+
+	previous := map[string]bool{}
+	for name := range t.secrets.Secrets {
+		previous[name] = true
+	}
+
+	if err := t.renderDependents(names); err != nil {
+		return nil, err
+	}
+
+	renewed := map[string]secrets.Secret{}
+	for name, secret := range t.secrets.Secrets {
+		if !previous[name] {
+			renewed[name] = secret
+		}
+	}
+	return renewed, nil
+}
+
+// RefreshStatic reads all secrets without a lease again, that were read with
+// the 'vault' function, and renders the templates using the secrets whose
+// data changed. Returns the names of the changed secrets.
+func (t *VaultifyTemplate) RefreshStatic() ([]string, error) {
+	names := make([]string, 0, len(t.reads))
+	for name := range t.reads {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var changed []string
+	updated := map[string]secrets.Secret{}
+	for _, name := range names {
+		previous, ok := t.secrets.Secrets[name]
+		if !ok || previous.LeaseID != "" || previous.Renewable {
+			continue
+		}
+
+		secret, err := t.reads[name]()
 		if err != nil {
 			return nil, err
 		}
-		defer file.Close()
-		file.Chmod(0600)
-		output = file
+		if secret == nil {
+			return nil, fmt.Errorf("secret '%s' not found", name)
+		}
+		if reflect.DeepEqual(previous.Data, secret.Data) {
+			continue
+		}
+
+		t.logger.Info("Secret changed", "name", name)
+		updated[name] = *secret
+		changed = append(changed, name)
 	}
 
-	err = t.render(bytes.NewBuffer(templateBytes), output)
-	if err != nil {
-		t.logger.Error("Error during rendering", "error", err)
+	if len(changed) == 0 {
+		return nil, nil
+	}
+
+	// Rendering uses the read secrets, the previous ones are restored if it
+	// fails, so the change is detected again
+	previous := map[string]secrets.Secret{}
+	for name, secret := range updated {
+		previous[name] = t.secrets.Secrets[name]
+		t.secrets.Secrets[name] = secret
+	}
+	if err := t.renderDependents(changed); err != nil {
+		for name, secret := range previous {
+			t.secrets.Secrets[name] = secret
+		}
 		return nil, err
 	}
+	return changed, nil
+}
 
-	return t.secrets, nil
+// renderDependents renders all templates using the given secrets again to
+// their previous output files, reusing the already read secrets.
+func (t *VaultifyTemplate) renderDependents(names []string) error {
+	var templateFiles []string
+	for _, name := range names {
+		for _, templateFile := range t.dependencies[name] {
+			if !contains(templateFiles, templateFile) {
+				templateFiles = append(templateFiles, templateFile)
+			}
+		}
+	}
+
+	rendered := make([][]byte, len(templateFiles))
+	for i, templateFile := range templateFiles {
+		t.logger.Info("Rendering template again", "template", templateFile)
+		output := new(bytes.Buffer)
+		if err := t.renderTemplate(templateFile, output); err != nil {
+			t.logger.Error("Error during rendering", "error", err)
+			return err
+		}
+		rendered[i] = output.Bytes()
+	}
+
+	for i, templateFile := range templateFiles {
+		for _, outputFile := range t.outputs[templateFile] {
+			if err := t.writeOutput(outputFile, rendered[i]); err != nil {
+				t.logger.Error("Failed to write output file", "outputFile", outputFile, "error", err)
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// outputDirectory is an output directory of a template directory, with the
+// mode of its template directory, or its own mode if it existed already.
+type outputDirectory struct {
+	path string
+	mode os.FileMode
 }
 
 func (t *VaultifyTemplate) RenderToDirectory(templateDir string, outputDir string) (*secrets.Secrets, error) {
 	t.logger.Info("Rendering template directory", "directory", templateDir)
 
+	var directories []outputDirectory
 	err := filepath.Walk(templateDir, func(templateFile string, info os.FileInfo, err error) error {
 		if err != nil {
 			t.logger.Error("Error visiting path", "path", templateFile, "error", err)
@@ -158,14 +570,44 @@ func (t *VaultifyTemplate) RenderToDirectory(templateDir string, outputDir strin
 		}
 		outputPath := path.Join(outputDir, relativePath)
 
+		if relativePath != "." && matchAny(t.currentDirectoryOptions.Exclude, relativePath) {
+			t.logger.Debug("Skipping excluded path", "path", templateFile)
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.IsDir() && len(t.currentDirectoryOptions.Include) > 0 && !matchAny(t.currentDirectoryOptions.Include, relativePath) {
+			t.logger.Debug("Skipping path not included", "path", templateFile)
+			return nil
+		}
+
 		if info.IsDir() {
-			t.logger.Info("Creating directory", "directory", outputPath)
-			// TODO: need to be writable while rendering templates but could
-			// probably be restored afterwards.
-			if err := os.MkdirAll(outputPath, info.Mode().Perm()|0700); err != nil {
-				t.logger.Error("Failed to create output directory structure", "outputPath", outputPath)
+			perm := t.currentPermissions
+			mode := info.Mode().Perm()
+			existing, err := os.Stat(outputPath)
+			if os.IsNotExist(err) {
+				t.logger.Info("Creating directory", "directory", outputPath)
+				if err := os.MkdirAll(outputPath, mode|0700); err != nil {
+					t.logger.Error("Failed to create output directory structure", "outputPath", outputPath)
+					return err
+				}
+			} else if err != nil {
+				t.logger.Error("Failed to read output directory", "outputPath", outputPath)
 				return err
+			} else if perm.mode == 0 && !perm.preserveMode {
+				// Existing directories keep their mode, unless a mode is
+				// configured. The owner is only changed if configured.
+				mode = existing.Mode().Perm()
 			}
+
+			// Writable while rendering templates, the mode is restored
+			// afterwards
+			if err := fileutil.SetPermissions(outputPath, mode|0700, perm.uid, perm.gid); err != nil {
+				t.logger.Error("Failed to change permissions of output directory", "outputPath", outputPath)
+				return err
+			}
+			directories = append(directories, outputDirectory{path: outputPath, mode: mode})
 			return nil
 
 		} else if info.Mode()&os.ModeSymlink != 0 {
@@ -176,14 +618,22 @@ func (t *VaultifyTemplate) RenderToDirectory(templateDir string, outputDir strin
 				return err
 			}
 
-			if err := os.Symlink(link, outputPath); err != nil {
+			// Replaces the symlink of a previous render
+			if err := fileutil.SymlinkAtomic(link, outputPath); err != nil {
 				t.logger.Error("Failed to create symlink", "outputPath", outputPath)
 				return err
 			}
 			return nil
 
 		} else if info.Mode().IsRegular() {
-			_, err = t.RenderToFile(templateFile, outputPath)
+			suffix := t.currentDirectoryOptions.TemplateSuffix
+			if suffix != "" && strings.HasSuffix(info.Name(), suffix) && info.Name() != suffix {
+				_, err = t.RenderToFile(templateFile, strings.TrimSuffix(outputPath, suffix))
+			} else if suffix != "" && t.currentDirectoryOptions.CopyNonTemplates {
+				err = t.copyToFile(templateFile, outputPath)
+			} else {
+				_, err = t.RenderToFile(templateFile, outputPath)
+			}
 			if err != nil {
 				return err
 			}
@@ -192,6 +642,16 @@ func (t *VaultifyTemplate) RenderToDirectory(templateDir string, outputDir strin
 		return nil
 	})
 
+	// Subdirectories first, their parents may not be searchable afterwards
+	for i := len(directories) - 1; i >= 0; i-- {
+		dir := directories[i]
+		if chmodErr := fileutil.SetPermissions(dir.path, dir.mode, -1, -1); chmodErr != nil && err == nil {
+			t.logger.Error("Failed to restore mode of output directory", "outputPath", dir.path)
+			err = chmodErr
+		}
+		t.directories[dir.path] = dir.mode
+	}
+
 	if err != nil {
 		return nil, err
 	}
@@ -199,14 +659,37 @@ func (t *VaultifyTemplate) RenderToDirectory(templateDir string, outputDir strin
 	return t.secrets, nil
 }
 
+func (t *VaultifyTemplate) renderTemplate(templateFile string, output io.Writer) error {
+	templateBytes, err := ioutil.ReadFile(templateFile)
+	if err != nil {
+		return err
+	}
+
+	t.currentTemplate = templateFile
+	defer func() { t.currentTemplate = "" }()
+	return t.render(bytes.NewBuffer(templateBytes), output)
+}
+
 func (t *VaultifyTemplate) render(input io.Reader, output io.Writer) error {
 	inputBytes, err := ioutil.ReadAll(input)
 	if err != nil {
 		return err
 	}
 
+	delims, ok := t.delimiters[t.currentTemplate]
+	if !ok {
+		delims = defaultDelimiters
+	}
+	if match := delimitersDirective.FindSubmatchIndex(inputBytes); match != nil {
+		delims = delimiters{
+			left:  string(inputBytes[match[2]:match[3]]),
+			right: string(inputBytes[match[4]:match[5]]),
+		}
+		inputBytes = inputBytes[match[1]:]
+	}
+
 	tmpl := template.New(templateName)
-	tmpl.Delims("<{", "}>")
+	tmpl.Delims(delims.left, delims.right)
 	tmpl.Funcs(t.funcMap)
 
 	_, err = tmpl.Parse(string(inputBytes))
@@ -221,3 +704,110 @@ func (t *VaultifyTemplate) render(input io.Reader, output io.Writer) error {
 
 	return nil
 }
+
+// RemoveOutputs removes all output files rendered by the template.
+func (t *VaultifyTemplate) RemoveOutputs() error {
+	for _, outputFiles := range t.outputs {
+		for _, outputFile := range outputFiles {
+			if outputFile == "" {
+				continue
+			}
+
+			t.logger.Info("Removing output file", "outputFile", outputFile)
+			err := t.withWritableDirectory(outputFile, func() error {
+				return os.Remove(outputFile)
+			})
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeOutput atomically replaces outputFile with the rendered data, and
+// records it as changed. Output files without changes keep their content, only
+// their permissions are updated. An empty outputFile writes to stdout.
+func (t *VaultifyTemplate) writeOutput(outputFile string, data []byte) error {
+	if outputFile == "" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+
+	perm, ok := t.permissions[outputFile]
+	if !ok {
+		perm = defaultPermissions
+	}
+
+	// unreadable and missing files are handled as changed
+	previous, err := ioutil.ReadFile(outputFile)
+	if err == nil && bytes.Equal(previous, data) {
+		t.logger.Debug("Output file did not change", "outputFile", outputFile)
+		// The permissions may have been changed
+		return fileutil.SetPermissions(outputFile, perm.mode, perm.uid, perm.gid)
+	}
+	err = t.withWritableDirectory(outputFile, func() error {
+		return fileutil.WriteAtomicOwned(outputFile, data, perm.mode, perm.uid, perm.gid)
+	})
+	if err != nil {
+		return err
+	}
+	t.changedOutputs = append(t.changedOutputs, outputFile)
+	return nil
+}
+
+// withWritableDirectory runs write with the directory of outputFile writable,
+// if it was created read-only by rendering a template directory.
+func (t *VaultifyTemplate) withWritableDirectory(outputFile string, write func() error) error {
+	dir := filepath.Dir(outputFile)
+	mode, ok := t.directories[dir]
+	if !ok || mode&0700 == 0700 {
+		return write()
+	}
+
+	if err := os.Chmod(dir, mode|0700); err != nil {
+		return err
+	}
+	err := write()
+	if chmodErr := os.Chmod(dir, mode); chmodErr != nil && err == nil {
+		err = chmodErr
+	}
+	return err
+}
+
+// parseParams parses "key=value" parameters.
+func parseParams(params []string) (map[string][]string, error) {
+	values := map[string][]string{}
+	for _, param := range params {
+		parts := strings.SplitN(param, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid parameter '%s', expected key=value", param)
+		}
+		values[parts[0]] = append(values[parts[0]], parts[1])
+	}
+	return values, nil
+}
+
+// matchAny returns true if the relative path, or its base name for patterns
+// without a separator, matches any of the glob patterns.
+func matchAny(patterns []string, relativePath string) bool {
+	for _, pattern := range patterns {
+		name := relativePath
+		if !strings.Contains(pattern, "/") {
+			name = filepath.Base(relativePath)
+		}
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -2,15 +2,18 @@ package template
 
 import (
 	"bytes"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 
 	"github.com/hashicorp/go-hclog"
 
+	"github.com/ahilsend/vaultify/pkg/options"
 	"github.com/ahilsend/vaultify/pkg/secrets"
 )
 
@@ -59,6 +62,156 @@ credentials:
 	renderAndCompare(t, secretReader, input, expectedOutput, []string{"secret/my/key"})
 }
 
+func TestRenderNamespace(t *testing.T) {
+
+	input := `
+credentials:
+  <{- $mySecret := vaultNS "ns1" "secret/my/key" }>
+  attribute1: <{ $mySecret.Data.attribute1 }>
+`
+
+	expectedOutput := `
+credentials:
+  attribute1: value1
+`
+	secretReader := secrets.NewMapReader(secrets.MapSecrets{
+		"ns1/secret/my/key": {
+			"attribute1": "value1",
+		},
+	})
+	renderAndCompare(t, secretReader, input, expectedOutput, []string{"ns1/secret/my/key"})
+}
+
+func TestRenderVersion(t *testing.T) {
+
+	input := `
+credentials:
+  <{- $mySecret := vault "secret/my/key" "version=3" }>
+  attribute1: <{ $mySecret.Data.attribute1 }>
+  version: <{ (vaultMetadata "secret/my/key").Data.current_version }>
+`
+
+	expectedOutput := `
+credentials:
+  attribute1: value3
+  version: 4
+`
+	secretReader := secrets.NewMapReader(secrets.MapSecrets{
+		"secret/my/key": {
+			"attribute1": "value4",
+		},
+		"secret/my/key?version=3": {
+			"attribute1": "value3",
+		},
+		"secret/my/key#metadata": {
+			"current_version": 4,
+		},
+	})
+	renderAndCompare(t, secretReader, input, expectedOutput, []string{"secret/my/key?version=3"})
+}
+
+func TestRenderWrite(t *testing.T) {
+
+	input := `
+<{- $cert := vaultWrite "pki/issue/web" "common_name=app.example.com" "ttl=24h" }>
+<{ $cert.Data.certificate }>
+<{ $cert.Data.private_key }>
+`
+
+	expectedOutput := `
+CERTIFICATE
+PRIVATE KEY
+`
+	secretReader := secrets.NewMapReader(secrets.MapSecrets{
+		"pki/issue/web?common_name=app.example.com&ttl=24h": {
+			"certificate": "CERTIFICATE",
+			"private_key": "PRIVATE KEY",
+		},
+	})
+	renderAndCompare(t, secretReader, input, expectedOutput, []string{"pki/issue/web?common_name=app.example.com&ttl=24h"})
+}
+
+func TestWrittenSecrets(t *testing.T) {
+	input := `
+<{- (vault "pki/cert/ca").Data.certificate }>
+<{ (vaultWrite "pki/issue/web" "common_name=app.example.com").Data.certificate }>
+`
+	template := New(hclog.Default(), secrets.NewMapReader(secrets.MapSecrets{
+		"pki/cert/ca": {"certificate": "CA"},
+		"pki/issue/web?common_name=app.example.com": {"certificate": "CERTIFICATE"},
+	}))
+	if err := template.render(strings.NewReader(input), new(bytes.Buffer)); err != nil {
+		t.Fatal(err)
+	}
+
+	written := template.WrittenSecrets()
+	if _, ok := written["pki/issue/web?common_name=app.example.com"]; !ok || len(written) != 1 {
+		t.Errorf("expected only the issued certificate to be written, got %v", written)
+	}
+}
+
+func TestRenderDelimitersDirective(t *testing.T) {
+	input := `# vaultify: delimiters [[ ]]
+attribute1: [[ (vault "secret/my/key").Data.attribute1 ]]
+literal: <{ not an action }>
+`
+
+	expectedOutput := `attribute1: value1
+literal: <{ not an action }>
+`
+	secretReader := secrets.NewMapReader(secrets.MapSecrets{
+		"secret/my/key": {
+			"attribute1": "value1",
+		},
+	})
+	renderAndCompare(t, secretReader, input, expectedOutput, []string{"secret/my/key"})
+}
+
+func TestRenderDelimiters(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	templateFile := path.Join(tmpDir, "config.hcl")
+	outputFile := path.Join(tmpDir, "output.hcl")
+	input := `password = "{{ (vault "secret/my/key").Data.attribute1 }}"
+map = <{ "key" = "value" }>
+`
+	if err := ioutil.WriteFile(templateFile, []byte(input), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	values := secrets.MapSecrets{
+		"secret/my/key": {"attribute1": "value1"},
+	}
+	template := New(hclog.Default(), secrets.NewMapReader(values))
+
+	templateConfig := options.NewTemplateConfig(templateFile, outputFile)
+	templateConfig.Delimiters = options.Delimiters{LeftDelimiter: "{{", RightDelimiter: "}}"}
+	if _, err := template.RenderToPath(options.CommonTemplateOptions{Templates: []options.TemplateConfig{templateConfig}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rendering again uses the delimiters of the template
+	values["secret/my/key"] = secrets.Value{"attribute1": "changed1"}
+	if _, err := template.Rerender("secret/my/key"); err != nil {
+		t.Fatal(err)
+	}
+
+	actual, err := ioutil.ReadFile(outputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `password = "changed1"
+map = <{ "key" = "value" }>
+`
+	if string(actual) != expected {
+		t.Errorf("expected %s but got %s", expected, actual)
+	}
+}
+
 func TestRenderToFile(t *testing.T) {
 	tmpDir, err := ioutil.TempDir("", t.Name())
 	if err != nil {
@@ -83,6 +236,44 @@ func TestRenderToFile(t *testing.T) {
 	compareFile(t, "testdata/expected/file1.yaml", dstFile)
 }
 
+func TestRenderToFileKeepsOutputOnError(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	templateFile := path.Join(tmpDir, "template.yaml")
+	if err := ioutil.WriteFile(templateFile, []byte(`password: <{ (vault "secret/unknown").Data.password }>`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	dstFile := path.Join(tmpDir, "output.yaml")
+	if err := ioutil.WriteFile(dstFile, []byte("password: previous\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	template := New(hclog.Default(), secrets.NewMapReader(secrets.MapSecrets{}))
+	if _, err := template.RenderToFile(templateFile, dstFile); err == nil {
+		t.Fatal("expected rendering to fail")
+	}
+
+	actual, err := ioutil.ReadFile(dstFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(actual) != "password: previous\n" {
+		t.Errorf("expected output to be unchanged, got %s", actual)
+	}
+
+	files, err := ioutil.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Errorf("expected no temporary files to be left, got %d files", len(files))
+	}
+}
+
 func compareFile(t *testing.T, expectedFilePath, actualFilePath string) {
 	expected, err := ioutil.ReadFile(expectedFilePath)
 	if err != nil {
@@ -126,6 +317,11 @@ func TestRenderToDirectory(t *testing.T) {
 	}
 	checkExpectedSecrets(t, secrets, []string{"secret/my/key", "secret/my/other-key"})
 
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
 	os.Chdir("testdata/expected")
 	err = filepath.Walk(".", func(file string, info os.FileInfo, err error) error {
 		if err != nil {
@@ -142,6 +338,364 @@ func TestRenderToDirectory(t *testing.T) {
 	}
 }
 
+func TestRerender(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	values := secrets.MapSecrets{
+		"secret/my/key": {
+			"attribute1": "value1",
+			"attribute2": "value2",
+		},
+		"secret/my/other-key": {
+			"attribute1": "value3",
+		},
+	}
+	template := New(hclog.Default(), secrets.NewMapReader(values))
+
+	file1 := path.Join(tmpDir, "file1.yaml")
+	file2 := path.Join(tmpDir, "file2.yaml")
+	if _, err := template.RenderToFile("testdata/templates/file1.yaml", file1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := template.RenderToFile("testdata/templates/file2.yaml", file2); err != nil {
+		t.Fatal(err)
+	}
+
+	checkChangedOutputs(t, template, []string{file1, file2})
+
+	values["secret/my/key"] = secrets.Value{"attribute1": "changed1"}
+	values["secret/my/other-key"] = secrets.Value{"attribute1": "changed3"}
+
+	renewed, err := template.Rerender("secret/my/other-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := renewed["secret/my/other-key"]; !ok || len(renewed) != 1 {
+		t.Errorf("expected only secret/my/other-key to be read again, got %v", renewed)
+	}
+
+	// Only file2 uses the re-read secret, and still uses the previous value of secret/my/key
+	compareFile(t, "testdata/expected/file1.yaml", file1)
+	actual, err := ioutil.ReadFile(file2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "credentials:\n  attribute1: value1\n  attribute2: changed3\n"
+	if string(actual) != expected {
+		t.Errorf("expected %s but got %s", expected, actual)
+	}
+	checkChangedOutputs(t, template, []string{file2})
+
+	// Rendering the same content again does not change the output
+	if _, err := template.Rerender("secret/my/other-key"); err != nil {
+		t.Fatal(err)
+	}
+	checkChangedOutputs(t, template, nil)
+}
+
+func TestRefreshStatic(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	values := secrets.MapSecrets{
+		"secret/my/key": {
+			"attribute1": "value1",
+			"attribute2": "value2",
+		},
+		"secret/my/other-key": {
+			"attribute1": "value3",
+		},
+	}
+	template := New(hclog.Default(), secrets.NewMapReader(values))
+
+	file1 := path.Join(tmpDir, "file1.yaml")
+	file2 := path.Join(tmpDir, "file2.yaml")
+	if _, err := template.RenderToFile("testdata/templates/file1.yaml", file1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := template.RenderToFile("testdata/templates/file2.yaml", file2); err != nil {
+		t.Fatal(err)
+	}
+	checkChangedOutputs(t, template, []string{file1, file2})
+
+	// Nothing changed
+	changed, err := template.RefreshStatic()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changed) != 0 {
+		t.Errorf("expected no changed secrets, got %v", changed)
+	}
+	checkChangedOutputs(t, template, nil)
+
+	values["secret/my/other-key"] = secrets.Value{"attribute1": "changed3"}
+
+	changed, err = template.RefreshStatic()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changed) != 1 || changed[0] != "secret/my/other-key" {
+		t.Errorf("expected secret/my/other-key to be changed, got %v", changed)
+	}
+
+	// Only file2 uses the changed secret
+	compareFile(t, "testdata/expected/file1.yaml", file1)
+	actual, err := ioutil.ReadFile(file2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "credentials:\n  attribute1: value1\n  attribute2: changed3\n"
+	if string(actual) != expected {
+		t.Errorf("expected %s but got %s", expected, actual)
+	}
+	checkChangedOutputs(t, template, []string{file2})
+
+	// A failed refresh does not lose the change of secret/my/key
+	values["secret/my/key"] = secrets.Value{"attribute1": "changed1", "attribute2": "changed2"}
+	otherKey := values["secret/my/other-key"]
+	delete(values, "secret/my/other-key")
+	if _, err := template.RefreshStatic(); err == nil {
+		t.Fatal("expected refresh to fail")
+	}
+	checkChangedOutputs(t, template, nil)
+
+	values["secret/my/other-key"] = otherKey
+	changed, err = template.RefreshStatic()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changed) != 1 || changed[0] != "secret/my/key" {
+		t.Errorf("expected secret/my/key to be changed, got %v", changed)
+	}
+	checkChangedOutputs(t, template, []string{file1, file2})
+}
+
+// countingReader counts the reads of every secret.
+type countingReader struct {
+	*secrets.MapSecretReader
+	reads map[string]int
+}
+
+func (reader *countingReader) Get(name string, params map[string][]string) (*secrets.Secret, error) {
+	reader.reads[name]++
+	return reader.MapSecretReader.Get(name, params)
+}
+
+func TestRenderReadsSecretsOnce(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	reader := &countingReader{
+		MapSecretReader: secrets.NewMapReader(secrets.MapSecrets{
+			"secret/my/key": {
+				"attribute1": "value1",
+				"attribute2": "value2",
+			},
+			"secret/my/other-key": {
+				"attribute1": "value3",
+			},
+		}),
+		reads: map[string]int{},
+	}
+	template := New(hclog.Default(), reader)
+
+	// Both templates read secret/my/key, the inline one twice
+	input := `<{ (vault "secret/my/key").Data.attribute1 }> <{ (vault "secret/my/key").Data.attribute2 }>`
+	if err := template.render(strings.NewReader(input), new(bytes.Buffer)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := template.RenderToFile("testdata/templates/file1.yaml", path.Join(tmpDir, "file1.yaml")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := template.RenderToFile("testdata/templates/file2.yaml", path.Join(tmpDir, "file2.yaml")); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, count := range reader.reads {
+		if count != 1 {
+			t.Errorf("expected secret %s to be read once, got %d reads", name, count)
+		}
+	}
+	if len(reader.reads) != 2 {
+		t.Errorf("expected 2 secrets to be read, got %v", reader.reads)
+	}
+}
+
+func TestRenderPermissions(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	templateDir := path.Join(tmpDir, "templates")
+	outputDir := path.Join(tmpDir, "output")
+	if err := os.MkdirAll(path.Join(templateDir, "sub"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	input := []byte(`attribute1: <{ (vault "secret/my/key").Data.attribute1 }>`)
+	if err := ioutil.WriteFile(path.Join(templateDir, "sub", "file.yaml"), input, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(templateDir, "other.yaml"), input, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path.Join(templateDir, "sub"), 0500); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(path.Join(outputDir, "sub"), 0700)
+
+	values := secrets.MapSecrets{
+		"secret/my/key": {"attribute1": "value1"},
+	}
+	template := New(hclog.Default(), secrets.NewMapReader(values))
+
+	templateOptions := options.CommonTemplateOptions{
+		TemplatePath: path.Join(templateDir, "other.yaml"),
+		OutputPath:   path.Join(tmpDir, "other.yaml"),
+		OutputMode:   0604,
+		Templates: []options.TemplateConfig{
+			{TemplatePath: templateDir, OutputPath: outputDir, PreserveMode: true, Uid: -1, Gid: -1},
+		},
+	}
+	if _, err := template.RenderToPath(templateOptions); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedModes := map[string]os.FileMode{
+		path.Join(tmpDir, "other.yaml"):          0604,
+		path.Join(outputDir, "other.yaml"):       0644,
+		path.Join(outputDir, "sub"):              0500 | os.ModeDir,
+		path.Join(outputDir, "sub", "file.yaml"): 0640,
+	}
+	checkModes := func() {
+		for file, expected := range expectedModes {
+			info, err := os.Stat(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode() != expected {
+				t.Errorf("expected %s to have mode %v, got %v", file, expected, info.Mode())
+			}
+		}
+	}
+	checkModes()
+
+	// Rerendering into the read-only directory keeps its mode
+	values["secret/my/key"] = secrets.Value{"attribute1": "changed1"}
+	if _, err := template.Rerender("secret/my/key"); err != nil {
+		t.Fatal(err)
+	}
+	actual, err := ioutil.ReadFile(path.Join(outputDir, "sub", "file.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(actual) != "attribute1: changed1" {
+		t.Errorf("expected rerendered output, got %s", actual)
+	}
+	checkModes()
+
+	// Changed permissions are applied to outputs without changes
+	templateOptions.OutputMode = 0640
+	templateOptions.Templates = nil
+	if _, err := template.RenderToPath(templateOptions); err != nil {
+		t.Fatal(err)
+	}
+	expectedModes = map[string]os.FileMode{
+		path.Join(tmpDir, "other.yaml"): 0640,
+	}
+	checkModes()
+}
+
+func TestRenderToDirectoryFiltered(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	templateDir := path.Join(tmpDir, "templates")
+	files := map[string]string{
+		"app.yaml.tmpl":   `attribute1: <{ (vault "secret/my/key").Data.attribute1 }>`,
+		"static.txt":      "<{ not a template",
+		"old.bak":         "backup",
+		"skip/other.tmpl": "skipped",
+	}
+	for name, content := range files {
+		file := path.Join(templateDir, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		directoryOptions options.DirectoryOptions
+		expected         map[string]string
+	}{
+		{
+			options.DirectoryOptions{Exclude: []string{"skip", "*.bak"}, TemplateSuffix: ".tmpl", CopyNonTemplates: true},
+			map[string]string{"app.yaml": "attribute1: value1", "static.txt": "<{ not a template"},
+		},
+		{
+			options.DirectoryOptions{Include: []string{"*.tmpl"}, Exclude: []string{"skip/*"}, TemplateSuffix: ".tmpl"},
+			map[string]string{"app.yaml": "attribute1: value1"},
+		},
+	}
+
+	for i, test := range tests {
+		outputDir := path.Join(tmpDir, fmt.Sprintf("output%d", i))
+		template := New(hclog.Default(), secrets.NewMapReader(secrets.MapSecrets{
+			"secret/my/key": {"attribute1": "value1"},
+		}))
+
+		templateConfig := options.NewTemplateConfig(templateDir, outputDir)
+		templateConfig.DirectoryOptions = test.directoryOptions
+		if _, err := template.RenderToPath(options.CommonTemplateOptions{Templates: []options.TemplateConfig{templateConfig}}); err != nil {
+			t.Fatal(err)
+		}
+
+		actual := map[string]string{}
+		err := filepath.Walk(outputDir, func(file string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			content, err := ioutil.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			relativePath, _ := filepath.Rel(outputDir, file)
+			actual[relativePath] = string(content)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("expected output files %v, got %v", test.expected, actual)
+		}
+	}
+}
+
+func checkChangedOutputs(t *testing.T, template *VaultifyTemplate, expected []string) {
+	changed := template.ChangedOutputs()
+	if strings.Join(changed, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected changed outputs %v but got %v", expected, changed)
+	}
+}
+
 func checkExpectedSecrets(t *testing.T, secrets *secrets.Secrets, expectedSecrets []string) {
 	for _, secret := range expectedSecrets {
 		if _, ok := secrets.Secrets[secret]; !ok {
@@ -170,3 +724,118 @@ func renderAndCompare(t *testing.T, secretReader secrets.SecretReader, input str
 
 	checkExpectedSecrets(t, template.secrets, expectedSecrets)
 }
+
+func TestRunWritesSecretsBeforeHooks(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	templateFile := path.Join(tmpDir, "template.yaml")
+	if err := ioutil.WriteFile(templateFile, []byte(`attribute1: <{ (vault "secret/my/key").Data.attribute1 }>`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	secretsFile := path.Join(tmpDir, "secrets.json")
+
+	// The process of the pid file is not running yet
+	err = Run(hclog.Default(), &Options{
+		CommonTemplateOptions: options.CommonTemplateOptions{
+			TemplatePath: templateFile,
+			OutputPath:   path.Join(tmpDir, "output.yaml"),
+			Variables:    map[string]string{"secret/my/key": `{"attribute1": "value1"}`},
+			HookOptions: options.HookOptions{
+				OnChangeSignal:  "SIGHUP",
+				OnChangePidFile: path.Join(tmpDir, "missing.pid"),
+			},
+		},
+		SecretsOutputFileName: secretsFile,
+	})
+	if err != nil {
+		t.Fatalf("expected failing hooks to be logged only, got %v", err)
+	}
+
+	if _, err := secrets.Read(secretsFile, nil); err != nil {
+		t.Errorf("expected secrets file to be written, got %v", err)
+	}
+}
+
+func TestRenderToExistingDirectory(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	templateDir := path.Join(tmpDir, "templates")
+	outputDir := path.Join(tmpDir, "output")
+	if err := os.MkdirAll(path.Join(templateDir, "sub"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	input := []byte(`attribute1: <{ (vault "secret/my/key").Data.attribute1 }>`)
+	if err := ioutil.WriteFile(path.Join(templateDir, "sub", "file.yaml"), input, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("sub/file.yaml", path.Join(templateDir, "link.yaml")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path.Join(templateDir, "sub"), 0500); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(path.Join(outputDir, "sub"), 0700)
+
+	// The output directories exist with another mode
+	if err := os.MkdirAll(path.Join(outputDir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(outputDir, 0750); err != nil {
+		t.Fatal(err)
+	}
+	checkMode := func(dir string, expected os.FileMode) {
+		info, err := os.Stat(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode() != expected|os.ModeDir {
+			t.Errorf("expected %s to have mode %v, got %v", dir, expected|os.ModeDir, info.Mode())
+		}
+	}
+
+	values := secrets.MapSecrets{
+		"secret/my/key": {"attribute1": "value1"},
+	}
+	for _, value := range []string{"value1", "changed1"} {
+		values["secret/my/key"] = secrets.Value{"attribute1": value}
+
+		// Every run renders with a new template, like another template
+		// command
+		template := New(hclog.Default(), secrets.NewMapReader(values))
+		if _, err := template.RenderToDirectory(templateDir, outputDir); err != nil {
+			t.Fatal(err)
+		}
+
+		actual, err := ioutil.ReadFile(path.Join(outputDir, "link.yaml"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(actual) != "attribute1: "+value {
+			t.Errorf("expected output through the symlink, got %s", actual)
+		}
+		// Existing directories keep their mode by default
+		checkMode(outputDir, 0750)
+		checkMode(path.Join(outputDir, "sub"), 0755)
+	}
+
+	// A configured mode is applied to existing directories
+	template := New(hclog.Default(), secrets.NewMapReader(values))
+	templateOptions := options.CommonTemplateOptions{
+		Templates: []options.TemplateConfig{
+			{TemplatePath: templateDir, OutputPath: outputDir, PreserveMode: true, Uid: -1, Gid: -1},
+		},
+	}
+	if _, err := template.RenderToPath(templateOptions); err != nil {
+		t.Fatal(err)
+	}
+	checkMode(outputDir, 0700)
+	checkMode(path.Join(outputDir, "sub"), 0500)
+}
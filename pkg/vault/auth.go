@@ -0,0 +1,425 @@
+package vault
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/api"
+	"github.com/hashicorp/vault/command/agent/auth"
+	"github.com/hashicorp/vault/command/agent/auth/approle"
+	"github.com/hashicorp/vault/command/agent/auth/kubernetes"
+)
+
+const (
+	AuthMethodKubernetes = "kubernetes"
+	AuthMethodToken      = "token"
+	AuthMethodAppRole    = "approle"
+	AuthMethodJwt        = "jwt"
+	AuthMethodCert       = "cert"
+	AuthMethodUserpass   = "userpass"
+)
+
+// Service account token mounted into kubernetes pods by default
+const defaultKubernetesTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// AuthMethods lists all supported auth methods
+var AuthMethods = []string{
+	AuthMethodKubernetes,
+	AuthMethodToken,
+	AuthMethodAppRole,
+	AuthMethodJwt,
+	AuthMethodCert,
+	AuthMethodUserpass,
+}
+
+// Authenticator logs in to vault.
+type Authenticator interface {
+	// Login returns the auth secret, containing the client token to use.
+	Login(client *api.Client) (*api.Secret, error)
+}
+
+// AuthConfig configures the auth method, and the credentials to log in with.
+type AuthConfig struct {
+	// Auth method, defaults to kubernetes
+	Method string
+	// Path the auth method is mounted at, defaults to auth/<method>
+	MountPath string
+
+	// Role for the kubernetes and jwt auth methods, and the certificate role
+	// for the cert auth method
+	Role string
+
+	// Service account token for the kubernetes auth method, defaults to the
+	// token mounted into the pod
+	KubernetesTokenPath string
+	// Expected audience of the service account token, e.g. of a projected
+	// service account token. Not checked if empty. It is only checked locally
+	// before logging in, the login request does not include it
+	KubernetesAudience string
+
+	// File containing the token for the token auth method, VAULT_TOKEN is used
+	// if not set
+	TokenFile string
+
+	// Files containing the role id and secret id for the approle auth method
+	RoleIdFile   string
+	SecretIdFile string
+
+	// File containing the JWT for the jwt auth method
+	JwtFile string
+
+	// Username, and file containing the password for the userpass auth method
+	Username     string
+	PasswordFile string
+}
+
+// NewAuthenticator returns the authenticator for the configured auth method.
+func NewAuthenticator(logger hclog.Logger, config *AuthConfig) (Authenticator, error) {
+	method := config.Method
+	if method == "" {
+		method = AuthMethodKubernetes
+	}
+	mountPath := config.MountPath
+	if mountPath == "" {
+		mountPath = "auth/" + method
+	}
+	mountPath = strings.TrimSuffix(mountPath, "/")
+
+	switch method {
+	case AuthMethodKubernetes:
+		tokenPath := config.KubernetesTokenPath
+		if tokenPath == "" {
+			tokenPath = defaultKubernetesTokenPath
+		}
+		authenticator, err := newAgentAuthenticator(kubernetes.NewKubernetesAuthMethod, logger, mountPath, map[string]interface{}{
+			"role":       config.Role,
+			"token_path": tokenPath,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &kubernetesAuthenticator{
+			agentAuthenticator: authenticator,
+			tokenPath:          tokenPath,
+			audience:           config.KubernetesAudience,
+		}, nil
+
+	case AuthMethodToken:
+		return &tokenAuthenticator{
+			tokenFile: config.TokenFile,
+		}, nil
+
+	case AuthMethodAppRole:
+		return newAgentAuthenticator(approle.NewApproleAuthMethod, logger, mountPath, map[string]interface{}{
+			"role_id_file_path":                   config.RoleIdFile,
+			"secret_id_file_path":                 config.SecretIdFile,
+			"remove_secret_id_file_after_reading": false,
+		})
+
+	case AuthMethodJwt:
+		if config.Role == "" || config.JwtFile == "" {
+			return nil, errors.New("the jwt auth method requires a role and a jwt file")
+		}
+		return &loginAuthenticator{
+			path: mountPath + "/login",
+			data: func() (map[string]interface{}, error) {
+				jwt, err := readFile(config.JwtFile)
+				return map[string]interface{}{
+					"role": config.Role,
+					"jwt":  jwt,
+				}, err
+			},
+		}, nil
+
+	case AuthMethodCert:
+		return &loginAuthenticator{
+			path: mountPath + "/login",
+			data: func() (map[string]interface{}, error) {
+				data := map[string]interface{}{}
+				if config.Role != "" {
+					data["name"] = config.Role
+				}
+				return data, nil
+			},
+		}, nil
+
+	case AuthMethodUserpass:
+		if config.Username == "" || config.PasswordFile == "" {
+			return nil, errors.New("the userpass auth method requires a username and a password file")
+		}
+		return &loginAuthenticator{
+			path: mountPath + "/login/" + config.Username,
+			data: func() (map[string]interface{}, error) {
+				password, err := readFile(config.PasswordFile)
+				return map[string]interface{}{
+					"password": password,
+				}, err
+			},
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown auth method '%s', supported are %s", method, strings.Join(AuthMethods, ", "))
+}
+
+// agentAuthenticator logs in with an auth method of the vault agent.
+type agentAuthenticator struct {
+	authMethod auth.AuthMethod
+}
+
+func newAgentAuthenticator(newAuthMethod func(*auth.AuthConfig) (auth.AuthMethod, error), logger hclog.Logger, mountPath string, config map[string]interface{}) (*agentAuthenticator, error) {
+	authMethod, err := newAuthMethod(&auth.AuthConfig{
+		MountPath: mountPath,
+		Logger:    logger,
+		Config:    config,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &agentAuthenticator{
+		authMethod: authMethod,
+	}, nil
+}
+
+func (a *agentAuthenticator) Login(client *api.Client) (*api.Secret, error) {
+	path, data, err := a.authMethod.Authenticate(context.Background(), client)
+	if err != nil {
+		return nil, err
+	}
+	return login(client, path, data)
+}
+
+// kubernetesAuthenticator logs in with a service account token, and checks
+// its audience before.
+type kubernetesAuthenticator struct {
+	*agentAuthenticator
+	tokenPath string
+	audience  string
+}
+
+func (a *kubernetesAuthenticator) Login(client *api.Client) (*api.Secret, error) {
+	if a.audience != "" {
+		if err := checkAudience(a.tokenPath, a.audience); err != nil {
+			return nil, err
+		}
+	}
+	return a.agentAuthenticator.Login(client)
+}
+
+// loginAuthenticator logs in by writing the login data to the login path of an
+// auth method.
+type loginAuthenticator struct {
+	path string
+	data func() (map[string]interface{}, error)
+}
+
+func (a *loginAuthenticator) Login(client *api.Client) (*api.Secret, error) {
+	data, err := a.data()
+	if err != nil {
+		return nil, err
+	}
+	return login(client, a.path, data)
+}
+
+// tokenAuthenticator uses an existing token, from a file or VAULT_TOKEN.
+type tokenAuthenticator struct {
+	tokenFile string
+}
+
+func (a *tokenAuthenticator) Login(client *api.Client) (*api.Secret, error) {
+	token := client.Token()
+	if a.tokenFile != "" {
+		fileToken, err := readFile(a.tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		token = fileToken
+	}
+	if token == "" {
+		return nil, fmt.Errorf("no token found, set %s or a token file", api.EnvVaultToken)
+	}
+
+	client.SetToken(token)
+	return lookupToken(client)
+}
+
+// secretAuthenticator uses an auth secret from a previous login. It can't log
+// in again once the auth secret expired.
+type secretAuthenticator struct {
+	authSecret *api.Secret
+	used       bool
+}
+
+func (a *secretAuthenticator) Login(client *api.Client) (*api.Secret, error) {
+	if a.used {
+		return nil, ErrCannotReauthenticate
+	}
+	a.used = true
+	if a.authSecret != nil && a.authSecret.Auth == nil && a.authSecret.WrapInfo != nil {
+		return unwrapToken(client, a.authSecret.WrapInfo.Token)
+	}
+	return a.authSecret, nil
+}
+
+// unwrapToken unwraps an auth token wrapped with Client.WrapAuthToken, and
+// looks it up. The wrapping token is checked to be created by
+// sys/wrapping/wrap, to detect tampering.
+func unwrapToken(client *api.Client, wrappingToken string) (*api.Secret, error) {
+	lookup, err := client.Logical().Write("sys/wrapping/lookup", map[string]interface{}{
+		"token": wrappingToken,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnwrapFailed, err)
+	}
+	if lookup == nil || lookup.Data["creation_path"] != wrapPath {
+		return nil, fmt.Errorf("%w: wrapping token was not created by %s", ErrUnwrapFailed, wrapPath)
+	}
+
+	// Unwrap with the wrapping token itself, not a token from the environment
+	client.SetToken("")
+	wrapped, err := client.Logical().Unwrap(wrappingToken)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnwrapFailed, err)
+	}
+	if wrapped == nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnwrapFailed, ErrRenewerNoSecretData)
+	}
+	token, ok := wrapped.Data["token"].(string)
+	if !ok || token == "" {
+		return nil, fmt.Errorf("%w: no token in wrapped response", ErrUnwrapFailed)
+	}
+
+	client.SetToken(token)
+	return lookupToken(client)
+}
+
+func login(client *api.Client, path string, data map[string]interface{}) (*api.Secret, error) {
+	secret, err := client.Logical().Write(path, data)
+	if err != nil {
+		return nil, err
+	}
+	// secret can be nil if vault is down during authentication
+	if secret == nil || secret.Auth == nil {
+		return nil, fmt.Errorf("error autenticating, %v", ErrRenewerNoSecretData)
+	}
+	return secret, nil
+}
+
+// lookupToken returns an auth secret for the token of the client, which can be
+// renewed like the auth secret of a login.
+func lookupToken(client *api.Client) (*api.Secret, error) {
+	self, err := client.Auth().Token().LookupSelf()
+	if err != nil {
+		return nil, err
+	}
+	if self == nil {
+		return nil, fmt.Errorf("error looking up token, %v", ErrRenewerNoSecretData)
+	}
+
+	renewable, err := self.TokenIsRenewable()
+	if err != nil {
+		return nil, err
+	}
+	ttl, err := self.TokenTTL()
+	if err != nil {
+		return nil, err
+	}
+	policies, err := self.TokenPolicies()
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := self.TokenMetadata()
+	if err != nil {
+		return nil, err
+	}
+	accessor, err := self.TokenAccessor()
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.Secret{
+		Auth: &api.SecretAuth{
+			ClientToken:   client.Token(),
+			Accessor:      accessor,
+			Policies:      policies,
+			Metadata:      metadata,
+			LeaseDuration: int(ttl.Seconds()),
+			Renewable:     renewable,
+		},
+	}, nil
+}
+
+// authRole returns the role the client is logged in with, used to label
+// metrics.
+func authRole(authSecret *api.Secret) (string, error) {
+	metadata, err := authSecret.TokenMetadata()
+	if err != nil {
+		return "", err
+	}
+	for _, key := range []string{"role", "role_name", "cert_name", "username"} {
+		if role, ok := metadata[key]; ok {
+			return role, nil
+		}
+	}
+	return "", nil
+}
+
+// checkAudience verifies that the JWT in tokenPath was issued for audience.
+// The signature is verified by vault on login, the audience is not: the
+// kubernetes login does not accept one, it is only enforced by vault if
+// configured on the role.
+func checkAudience(tokenPath string, audience string) error {
+	jwt, err := readFile(tokenPath)
+	if err != nil {
+		return err
+	}
+
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("service account token %s is not a JWT", tokenPath)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return fmt.Errorf("failed to decode service account token %s: %v", tokenPath, err)
+	}
+
+	var claims struct {
+		Audience interface{} `json:"aud"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return fmt.Errorf("failed to decode service account token %s: %v", tokenPath, err)
+	}
+
+	// The audience claim is either a string or a list of strings
+	var audiences []string
+	switch aud := claims.Audience.(type) {
+	case string:
+		audiences = []string{aud}
+	case []interface{}:
+		for _, a := range aud {
+			if s, ok := a.(string); ok {
+				audiences = append(audiences, s)
+			}
+		}
+	}
+
+	for _, aud := range audiences {
+		if aud == audience {
+			return nil
+		}
+	}
+	return fmt.Errorf("service account token %s is issued for audience %v, expected '%s'", tokenPath, audiences, audience)
+}
+
+func readFile(filename string) (string, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(content)), nil
+}
@@ -0,0 +1,135 @@
+package vault
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+func TestCheckAudience(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	tests := []struct {
+		claims   string
+		audience string
+		valid    bool
+	}{
+		{`{"aud":"vault"}`, "vault", true},
+		{`{"aud":["api","vault"]}`, "vault", true},
+		{`{"aud":["api"]}`, "vault", false},
+		{`{"sub":"system:serviceaccount:default:app"}`, "vault", false},
+	}
+
+	for _, test := range tests {
+		tokenPath := path.Join(tmpDir, "token")
+		jwt := "e30." + base64.RawURLEncoding.EncodeToString([]byte(test.claims)) + ".c2lnbmF0dXJl"
+		if err := ioutil.WriteFile(tokenPath, []byte(jwt), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		err := checkAudience(tokenPath, test.audience)
+		if test.valid && err != nil {
+			t.Errorf("[%s] expected audience %s to be valid, got %v", test.claims, test.audience, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("[%s] expected audience %s to be invalid", test.claims, test.audience)
+		}
+	}
+}
+
+func TestTokenFileLogin(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	vault := newFakeVault(t, map[string]http.HandlerFunc{
+		"/v1/auth/token/lookup-self": func(w http.ResponseWriter, r *http.Request) {
+			if token := r.Header.Get("X-Vault-Token"); token != "operator-token" {
+				t.Errorf("expected token of the token file to be looked up, got '%s'", token)
+			}
+			writeJSON(w, lookupResponse("operator-token", 3600, true))
+		},
+	})
+	defer vault.Close()
+
+	client, err := NewClient(hclog.NewNullLogger(), &AuthConfig{
+		Method:    AuthMethodToken,
+		TokenFile: writeTempFile(t, tmpDir, "token", "operator-token\n"),
+	}, vault.config())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	auth := client.AuthSecret().Auth
+	if client.ApiClient.Token() != "operator-token" || auth.Accessor != "accessor-operator-token" || auth.LeaseDuration != 3600 || !auth.Renewable {
+		t.Errorf("expected auth secret of the looked up token, got %+v", auth)
+	}
+	if !client.ExternalAuthToken() {
+		t.Error("expected the token of the token file to be external")
+	}
+	if client.role != "app" {
+		t.Errorf("expected role app, got '%s'", client.role)
+	}
+}
+
+func TestJwtLogin(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	vault := newFakeVault(t, map[string]http.HandlerFunc{
+		"/v1/auth/jwt-ci/login": func(w http.ResponseWriter, r *http.Request) {
+			var data map[string]string
+			if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+				t.Error(err)
+			}
+			if data["role"] != "ci" || data["jwt"] != "header.payload.signature" {
+				t.Errorf("expected login with role and jwt, got %v", data)
+			}
+			writeJSON(w, authResponse("jwt-token", 3600, true))
+		},
+	})
+	defer vault.Close()
+
+	client, err := NewClient(hclog.NewNullLogger(), &AuthConfig{
+		Method:    AuthMethodJwt,
+		MountPath: "auth/jwt-ci/",
+		Role:      "ci",
+		JwtFile:   writeTempFile(t, tmpDir, "jwt", "header.payload.signature\n"),
+	}, vault.config())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if client.ApiClient.Token() != "jwt-token" {
+		t.Errorf("expected token of the login, got '%s'", client.ApiClient.Token())
+	}
+	if client.ExternalAuthToken() {
+		t.Error("expected the token of the login not to be external")
+	}
+	if count := vault.count("/v1/auth/jwt-ci/login"); count != 1 {
+		t.Errorf("expected a single login, got %d", count)
+	}
+}
+
+func TestJwtLoginRequiresRoleAndFile(t *testing.T) {
+	if _, err := NewAuthenticator(hclog.NewNullLogger(), &AuthConfig{Method: AuthMethodJwt, Role: "ci"}); err == nil {
+		t.Error("expected error without jwt file")
+	}
+	if _, err := NewAuthenticator(hclog.NewNullLogger(), &AuthConfig{Method: AuthMethodJwt, JwtFile: "jwt"}); err == nil {
+		t.Error("expected error without role")
+	}
+}
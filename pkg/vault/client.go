@@ -3,55 +3,132 @@ package vault
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
+	"sync"
+	"time"
 
 	"github.com/ahilsend/vaultify/pkg/prometheus"
 	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/vault/api"
-	"github.com/hashicorp/vault/command/agent/auth"
-	"github.com/hashicorp/vault/command/agent/auth/kubernetes"
 )
 
 var ErrRenewerNoSecretData = api.ErrRenewerNoSecretData
 
+var ErrCannotReauthenticate = errors.New("no auth method configured to log in again")
+
+var ErrUnwrapFailed = errors.New("failed to unwrap auth token, it can only be unwrapped once")
+
+var ErrSameAuthToken = errors.New("logging in again returned the same auth token, it can't be replaced before it expires")
+
+// Backoff between failed attempts to log in again
+var (
+	reauthInitialBackoff = time.Second
+	reauthMaxBackoff     = 2 * time.Minute
+	reauthAttempts       = 8
+)
+
+// Fraction of the TTL of a non-renewable auth token before its expiry, at
+// which vaultify logs in again
+const authExpiryGraceFraction = 0.1
+
+const wrapPath = "sys/wrapping/wrap"
+
+// Config configures the vault client, in addition to the settings of the vault
+// api config.
+type Config struct {
+	*api.Config
+
+	// Namespace of all requests, VAULT_NAMESPACE is used if not set
+	// (Vault Enterprise)
+	Namespace string
+
+	// TLS settings of the connection, applied on top of the settings from the
+	// VAULT_CACERT, VAULT_CAPATH, VAULT_CLIENT_CERT, VAULT_CLIENT_KEY,
+	// VAULT_TLS_SERVER_NAME and VAULT_SKIP_VERIFY environment variables
+	TLS *api.TLSConfig
+}
+
+// Renewal is a renewed secret lease, or a renewed or new auth token.
+type Renewal struct {
+	// Name of the secret, or AuthTokenName for the auth token
+	Name   string
+	Secret *api.Secret
+}
+
 type Client struct {
-	ApiClient   *api.Client
-	AuthSecret  *api.Secret
+	ApiClient *api.Client
+
+	// Guards the auth token, which is replaced when logging in again
+	authMutex  sync.Mutex
+	authSecret *api.Secret
+	// Expiry of the auth token, zero if it never expires
+	authExpiry  time.Time
 	authRenewer *api.Renewer
-	role        string
-	doneCh      chan error
-	logger      hclog.Logger
+
+	authenticator Authenticator
+	// The auth token is supplied with the token auth method, not obtained by
+	// logging in
+	externalToken bool
+	role          string
+	doneCh        chan error
+	expiredCh     chan string
+	renewedCh     chan Renewal
+	logger        hclog.Logger
 }
 
-func NewClient(logger hclog.Logger, role string, config *api.Config) (*Client, error) {
-	return createClient(logger, func(client *api.Client) (*api.Secret, string, error) {
-		authSecret, err := kubernetesAuthentication(client, logger, role)
-		return authSecret, role, err
-	}, config)
+func NewClient(logger hclog.Logger, authConfig *AuthConfig, config *Config) (*Client, error) {
+	authenticator, err := NewAuthenticator(logger, authConfig)
+	if err != nil {
+		return nil, err
+	}
+	return createClient(logger, authenticator, config)
 }
 
-func NewClientFromSecret(logger hclog.Logger, authSecret *api.Secret, config *api.Config) (*Client, error) {
-	return createClient(logger, func(client *api.Client) (*api.Secret, string, error) {
-		metadata, err := authSecret.TokenMetadata()
-		return authSecret, metadata["role"], err
-	}, config)
+// NewClientFromSecret creates a client using the auth secret of a previous
+// login, e.g. from the secrets file. authExpiry is the stored expiry of the
+// auth token, if known.
+func NewClientFromSecret(logger hclog.Logger, authSecret *api.Secret, authExpiry *time.Time, config *Config) (*Client, error) {
+	client, err := createClient(logger, &secretAuthenticator{authSecret: authSecret}, config)
+	if err != nil {
+		return nil, err
+	}
+
+	// The lease duration of a stored auth secret is the one of its last
+	// renewal, the stored expiry is accurate. An unwrapped token is looked
+	// up, its lease duration is current.
+	if authExpiry != nil && client.AuthSecret() == authSecret && authSecret.Auth.LeaseDuration > 0 {
+		client.authExpiry = *authExpiry
+	}
+	return client, nil
 }
 
-func createClient(logger hclog.Logger, auth func(*api.Client) (*api.Secret, string, error), config *api.Config) (*Client, error) {
-	vaultConfig := mergeConfig(api.DefaultConfig(), config)
+func createClient(logger hclog.Logger, authenticator Authenticator, config *Config) (*Client, error) {
+	vaultConfig, err := mergeConfig(api.DefaultConfig(), config)
+	if err != nil {
+		return nil, err
+	}
 
 	client, err := api.NewClient(vaultConfig)
 	if err != nil {
 		return nil, err
 	}
+	if namespace := config.namespace(); namespace != "" {
+		client.SetNamespace(namespace)
+	}
 
-	authSecret, role, err := auth(client)
+	authSecret, err := authenticator.Login(client)
 	if err != nil {
 		return nil, err
 	}
 	if authSecret == nil {
 		return nil, ErrRenewerNoSecretData
 	}
+	role, err := authRole(authSecret)
+	if err != nil {
+		return nil, err
+	}
 	client.SetToken(authSecret.Auth.ClientToken)
 	renewer, err := client.NewRenewer(&api.RenewerInput{
 		Secret: authSecret,
@@ -60,17 +137,31 @@ func createClient(logger hclog.Logger, auth func(*api.Client) (*api.Secret, stri
 		return nil, err
 	}
 
+	_, externalToken := authenticator.(*tokenAuthenticator)
+
 	return &Client{
-		ApiClient:   client,
-		AuthSecret:  authSecret,
-		authRenewer: renewer,
-		role:        role,
-		doneCh:      make(chan error, 1),
-		logger:      logger,
+		ApiClient:     client,
+		authSecret:    authSecret,
+		authExpiry:    tokenExpiry(authSecret, time.Now()),
+		authRenewer:   renewer,
+		authenticator: authenticator,
+		externalToken: externalToken,
+		role:          role,
+		doneCh:        make(chan error, 1),
+		logger:        logger,
 	}, err
 }
 
-func mergeConfig(vaultConfig *api.Config, config *api.Config) *api.Config {
+// namespace returns the namespace of the config, or of VAULT_NAMESPACE. The
+// vault api does not read VAULT_NAMESPACE itself.
+func (config *Config) namespace() string {
+	if config.Namespace != "" {
+		return config.Namespace
+	}
+	return os.Getenv(api.EnvVaultNamespace)
+}
+
+func mergeConfig(vaultConfig *api.Config, config *Config) (*api.Config, error) {
 	if config.Address != "" {
 		vaultConfig.Address = config.Address
 	}
@@ -93,33 +184,13 @@ func mergeConfig(vaultConfig *api.Config, config *api.Config) *api.Config {
 		vaultConfig.Limiter = config.Limiter
 	}
 
-	return vaultConfig
-}
-
-func kubernetesAuthentication(v *api.Client, logger hclog.Logger, role string) (*api.Secret, error) {
-	authMethod, err := kubernetes.NewKubernetesAuthMethod(&auth.AuthConfig{
-		MountPath: "auth/kubernetes",
-		Logger:    logger,
-		Config: map[string]interface{}{
-			"role": role,
-		},
-	})
-	if err != nil {
-		return nil, err
-	}
-	path, data, err := authMethod.Authenticate(context.Background(), v)
-	if err != nil {
-		return nil, err
-	}
-	secret, err := v.Logical().Write(path, data)
-	if err != nil {
-		return nil, err
-	}
-	// secret can be nil if vault is down during authentication
-	if secret == nil {
-		return nil, fmt.Errorf("error autenticating, %v", ErrRenewerNoSecretData)
+	if config.TLS != nil {
+		if err := vaultConfig.ConfigureTLS(config.TLS); err != nil {
+			return nil, fmt.Errorf("invalid TLS configuration: %v", err)
+		}
 	}
-	return secret, nil
+
+	return vaultConfig, nil
 }
 
 func (v *Client) Wait(ctx context.Context) error {
@@ -143,24 +214,86 @@ func (v *Client) DoneCh() chan error {
 	return v.doneCh
 }
 
+// NotifyExpired makes secret lease renewers publish the name of the secret on
+// the returned channel when its lease can no longer be renewed, instead of
+// stopping the client through the done channel.
+func (v *Client) NotifyExpired() <-chan string {
+	v.expiredCh = make(chan string, 1)
+	return v.expiredCh
+}
+
+// NotifyRenewed returns a channel receiving every renewed secret lease and auth
+// token, e.g. to persist the current lease state. It has to be called before
+// the renewals are started, and the channel has to be drained.
+func (v *Client) NotifyRenewed() <-chan Renewal {
+	v.renewedCh = make(chan Renewal, 1)
+	return v.renewedCh
+}
+
+// notifyRenewed reports a renewal, if requested through NotifyRenewed.
+func (v *Client) notifyRenewed(ctx context.Context, name string, secret *api.Secret) {
+	if v.renewedCh == nil {
+		return
+	}
+
+	select {
+	case <-ctx.Done():
+	case v.renewedCh <- Renewal{Name: name, Secret: secret}:
+	}
+}
+
+// AuthSecret returns the auth secret of the current auth token.
+func (v *Client) AuthSecret() *api.Secret {
+	v.authMutex.Lock()
+	defer v.authMutex.Unlock()
+	return v.authSecret
+}
+
+// auth returns the auth secret of the current auth token, its expiry, and its
+// renewer.
+func (v *Client) auth() (*api.Secret, time.Time, *api.Renewer) {
+	v.authMutex.Lock()
+	defer v.authMutex.Unlock()
+	return v.authSecret, v.authExpiry, v.authRenewer
+}
+
 func (v *Client) StartAuthRenewal(ctx context.Context) {
 	v.logger.Info("starting auth lease renewal")
-	go v.authRenewer.Renew()
+	_, _, renewer := v.auth()
+	go renewer.Renew()
 
 	for {
 		select {
 		case <-ctx.Done():
 			v.logger.Info("shutdown triggered, stopping auth lease renewal")
-			v.authRenewer.Stop()
+			renewer.Stop()
 			return
 
-		case err := <-v.authRenewer.DoneCh():
-			prometheus.IncAuthLeaseFailed(v.role)
-			v.logger.Warn("auth lease renewer done channel triggered")
-			v.doneCh <- fmt.Errorf("auth lease renewer done: %v", err)
-			return
+		case err := <-renewer.DoneCh():
+			if err == api.ErrRenewerNotRenewable {
+				// A non-renewable token, like a batch token, is used until
+				// shortly before it expires
+				if !v.waitForExpiry(ctx) {
+					return
+				}
+			} else {
+				prometheus.IncAuthLeaseFailed(v.role)
+				v.logger.Warn("auth lease renewer done channel triggered", "reason", err)
+			}
+			if reauthErr := v.reauthenticateWithBackoff(ctx); reauthErr != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				v.logger.Error("failed to log in again", "error", reauthErr)
+				v.doneCh <- fmt.Errorf("auth lease renewer done: %w", reauthErr)
+				return
+			}
+			var authSecret *api.Secret
+			authSecret, _, renewer = v.auth()
+			v.notifyRenewed(ctx, AuthTokenName, authSecret)
+			go renewer.Renew()
 
-		case renewed := <-v.authRenewer.RenewCh():
+		case renewed := <-renewer.RenewCh():
 			// nil checking for renewed secret
 			if renewed.Secret == nil {
 				v.logger.Error("auth lease renewer returned empty secret")
@@ -180,28 +313,136 @@ func (v *Client) StartAuthRenewal(ctx context.Context) {
 			if hasWarnings {
 				v.logger.Warn("Lease warning", "lease_warning", renewed.Secret.Warnings)
 			}
+			v.notifyRenewed(ctx, AuthTokenName, renewed.Secret)
 			break
 		}
 	}
 }
 
-func (v *Client) RenewLeases(ctx context.Context, secretMap map[string]api.Secret) {
-	for name, secret := range secretMap {
-		if !secret.Renewable {
-			continue
+// waitForExpiry waits until the non-renewable auth token is about to expire.
+// A token without expiry never has to be replaced, it waits until the
+// shutdown. Returns false on shutdown.
+func (v *Client) waitForExpiry(ctx context.Context) bool {
+	authSecret, expiry, _ := v.auth()
+	if expiry.IsZero() {
+		v.logger.Info("auth token is not renewable and does not expire")
+		<-ctx.Done()
+		return false
+	}
+
+	ttl := time.Duration(authSecret.Auth.LeaseDuration) * time.Second
+	loginAt := expiry.Add(-time.Duration(float64(ttl) * authExpiryGraceFraction))
+	v.logger.Info("auth token is not renewable, logging in again before it expires",
+		"expiry", expiry,
+		"loginAt", loginAt)
+
+	timer := time.NewTimer(time.Until(loginAt))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// reauthenticateWithBackoff logs in again, and retries failed logins with an
+// exponential backoff. Getting the same token again, or an auth method that
+// can't log in again, is not retried.
+func (v *Client) reauthenticateWithBackoff(ctx context.Context) error {
+	backoff := reauthInitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := v.reauthenticate()
+		if err == nil || err == ErrSameAuthToken || err == ErrCannotReauthenticate || attempt >= reauthAttempts {
+			return err
+		}
+
+		v.logger.Warn("failed to log in again, retrying",
+			"error", err,
+			"attempt", attempt,
+			"backoff", backoff)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
 		}
 
-		// local copy of secret or the reference to it will be incorrect
-		renewerSecret := secret
-		renewer, err := v.ApiClient.NewRenewer(&api.RenewerInput{
-			Secret: &renewerSecret,
-		})
-		if err != nil {
+		backoff *= 2
+		if backoff > reauthMaxBackoff {
+			backoff = reauthMaxBackoff
+		}
+	}
+}
+
+// reauthenticate logs in again with the auth method, and replaces the token
+// and the auth renewer. Secret lease renewers keep running with the new
+// token. Fails with ErrSameAuthToken if the auth method returns the current
+// token again, e.g. the token auth method.
+func (v *Client) reauthenticate() error {
+	v.logger.Info("logging in again")
+
+	// log in without the expired token
+	loginClient, err := v.ApiClient.Clone()
+	if err != nil {
+		return err
+	}
+	loginClient.SetHeaders(v.ApiClient.Headers())
+
+	authSecret, err := v.authenticator.Login(loginClient)
+	if err != nil {
+		return err
+	}
+	if authSecret == nil || authSecret.Auth == nil {
+		return ErrRenewerNoSecretData
+	}
+	if sameToken(v.AuthSecret(), authSecret) {
+		return ErrSameAuthToken
+	}
+	renewer, err := v.ApiClient.NewRenewer(&api.RenewerInput{
+		Secret: authSecret,
+	})
+	if err != nil {
+		return err
+	}
+
+	v.authMutex.Lock()
+	v.ApiClient.SetToken(authSecret.Auth.ClientToken)
+	v.authSecret = authSecret
+	v.authExpiry = tokenExpiry(authSecret, time.Now())
+	v.authRenewer = renewer
+	v.authMutex.Unlock()
+	prometheus.IncAuthReauthenticated(v.role)
+	v.logger.Info("logged in again")
+	return nil
+}
+
+// sameToken returns true if both auth secrets contain the same token, by
+// token or accessor.
+func sameToken(current *api.Secret, authSecret *api.Secret) bool {
+	if current == nil || current.Auth == nil {
+		return false
+	}
+	return current.Auth.ClientToken == authSecret.Auth.ClientToken ||
+		(current.Auth.Accessor != "" && current.Auth.Accessor == authSecret.Auth.Accessor)
+}
+
+// tokenExpiry returns when the auth token obtained at now expires, or zero if
+// it never expires.
+func tokenExpiry(authSecret *api.Secret, now time.Time) time.Time {
+	if authSecret.Auth == nil || authSecret.Auth.LeaseDuration == 0 {
+		return time.Time{}
+	}
+	return now.Add(time.Duration(authSecret.Auth.LeaseDuration) * time.Second)
+}
+
+func (v *Client) RenewLeases(ctx context.Context, secretMap map[string]api.Secret) {
+	for name, secret := range secretMap {
+		if err := v.RenewLease(ctx, name, secret); err != nil {
 			v.doneCh <- err
 			return
 		}
-
-		go v.startRenewal(ctx, name, renewer)
 	}
 
 	for {
@@ -212,6 +453,25 @@ func (v *Client) RenewLeases(ctx context.Context, secretMap map[string]api.Secre
 	}
 }
 
+// RenewLease starts renewing the lease of a single secret in the background.
+// Secrets that are not renewable are ignored.
+func (v *Client) RenewLease(ctx context.Context, name string, secret api.Secret) error {
+	if !secret.Renewable {
+		return nil
+	}
+
+	// secret is a local copy, so the renewer keeps a valid reference to it
+	renewer, err := v.ApiClient.NewRenewer(&api.RenewerInput{
+		Secret: &secret,
+	})
+	if err != nil {
+		return err
+	}
+
+	go v.startRenewal(ctx, name, renewer)
+	return nil
+}
+
 func (v *Client) startRenewal(ctx context.Context, name string, renewer *api.Renewer) {
 	v.logger.Info("starting lease renewal for secret", "name", name)
 	go renewer.Renew()
@@ -226,14 +486,15 @@ func (v *Client) startRenewal(ctx context.Context, name string, renewer *api.Ren
 		case err := <-renewer.DoneCh():
 			prometheus.IncSecretLeaseFailed(v.role, name)
 			v.logger.Warn("lease renewer done channel triggered", "name", name)
-			v.doneCh <- fmt.Errorf("lease renewer done: %v", err)
+			v.leaseDone(ctx, name, fmt.Errorf("lease renewer done: %v", err))
 			return
 
 		case renewed := <-renewer.RenewCh():
 			if renewed.Secret == nil {
 				v.logger.Error("lease renewer returned empty secret")
 				prometheus.IncSecretLeaseFailed(v.role, name)
-				v.doneCh <- ErrRenewerNoSecretData
+				renewer.Stop()
+				v.leaseDone(ctx, name, ErrRenewerNoSecretData)
 				return
 			}
 			hasWarnings := len(renewed.Secret.Warnings) > 0
@@ -255,7 +516,92 @@ func (v *Client) startRenewal(ctx context.Context, name string, renewer *api.Ren
 			if hasWarnings {
 				v.logger.Warn("Lease warning", "lease_warning", renewed.Secret.Warnings)
 			}
+			v.notifyRenewed(ctx, name, renewed.Secret)
 			break
 		}
 	}
 }
+
+// leaseDone reports a secret whose lease is no longer renewed, either on the
+// expired channel if requested through NotifyExpired, or on the done channel.
+func (v *Client) leaseDone(ctx context.Context, name string, err error) {
+	if v.expiredCh == nil {
+		v.doneCh <- err
+		return
+	}
+
+	v.logger.Info("secret lease can no longer be renewed", "name", name, "reason", err)
+	select {
+	case <-ctx.Done():
+	case v.expiredCh <- name:
+	}
+}
+
+// RevokeLeases revokes the leases of all given secrets, e.g. to not leave
+// dynamic database users behind on shutdown.
+func (v *Client) RevokeLeases(secretMap map[string]api.Secret) error {
+	failed := 0
+	for name, secret := range secretMap {
+		if secret.LeaseID == "" {
+			continue
+		}
+
+		v.logger.Info("revoking secret lease", "name", name)
+		if err := v.ApiClient.Sys().Revoke(secret.LeaseID); err != nil {
+			v.logger.Error("failed to revoke secret lease", "name", name, "error", err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("failed to revoke %d secret leases", failed)
+	}
+	return nil
+}
+
+// WrapAuthToken wraps the auth token with response wrapping, and returns a
+// secret with only the wrapping token. NewClientFromSecret unwraps it, which
+// is possible only once, within ttl.
+func (v *Client) WrapAuthToken(ttl time.Duration) (*api.Secret, error) {
+	wrapClient, err := v.ApiClient.Clone()
+	if err != nil {
+		return nil, err
+	}
+	wrapClient.SetHeaders(v.ApiClient.Headers())
+	wrapClient.SetToken(v.ApiClient.Token())
+	wrapClient.SetWrappingLookupFunc(func(operation, path string) string {
+		return ttl.String()
+	})
+
+	v.logger.Info("wrapping auth token", "ttl", ttl)
+	secret, err := wrapClient.Logical().Write(wrapPath, map[string]interface{}{
+		"token": v.ApiClient.Token(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil || secret.WrapInfo == nil {
+		return nil, fmt.Errorf("error wrapping auth token, %v", ErrRenewerNoSecretData)
+	}
+	return &api.Secret{WrapInfo: secret.WrapInfo}, nil
+}
+
+// Role returns the role the client is logged in with, used to label metrics.
+func (v *Client) Role() string {
+	return v.role
+}
+
+// ExternalAuthToken returns true if the auth token was supplied to vaultify
+// with the token auth method, instead of obtained by logging in. Such a token
+// must not be revoked, it would revoke the tokens and leases of its owner as
+// well.
+func (v *Client) ExternalAuthToken() bool {
+	return v.externalToken
+}
+
+// RevokeAuthToken revokes the auth token, the client can't be used anymore
+// afterwards.
+func (v *Client) RevokeAuthToken() error {
+	v.logger.Info("revoking auth token")
+	return v.ApiClient.Auth().Token().RevokeSelf("")
+}
@@ -0,0 +1,387 @@
+package vault
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/api"
+)
+
+func TestMergeConfigTLS(t *testing.T) {
+	tests := []struct {
+		tls   *api.TLSConfig
+		valid bool
+	}{
+		{nil, true},
+		{&api.TLSConfig{TLSServerName: "vault.example.com", Insecure: true}, true},
+		{&api.TLSConfig{ClientCert: "testdata/client.pem"}, false},
+		{&api.TLSConfig{CACert: "testdata/missing.pem"}, false},
+	}
+
+	for _, test := range tests {
+		vaultConfig, err := mergeConfig(api.DefaultConfig(), &Config{
+			Config: &api.Config{},
+			TLS:    test.tls,
+		})
+		if test.valid && err != nil {
+			t.Errorf("[%+v] expected valid TLS config, got %v", test.tls, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("[%+v] expected invalid TLS config", test.tls)
+		}
+
+		if test.valid && test.tls != nil {
+			tlsConfig := vaultConfig.HttpClient.Transport.(*http.Transport).TLSClientConfig
+			if tlsConfig.ServerName != test.tls.TLSServerName || tlsConfig.InsecureSkipVerify != test.tls.Insecure {
+				t.Errorf("[%+v] TLS config not applied", test.tls)
+			}
+		}
+	}
+}
+
+func TestClientNamespace(t *testing.T) {
+	defer os.Unsetenv(api.EnvVaultNamespace)
+	authSecret := &api.Secret{Auth: &api.SecretAuth{ClientToken: "token"}}
+
+	tests := []struct {
+		env       string
+		namespace string
+		expected  string
+	}{
+		{"", "", ""},
+		{"team-a", "", "team-a"},
+		{"team-a", "team-b", "team-b"},
+	}
+
+	for _, test := range tests {
+		os.Setenv(api.EnvVaultNamespace, test.env)
+		client, err := NewClientFromSecret(hclog.NewNullLogger(), authSecret, nil, &Config{
+			Config:    &api.Config{},
+			Namespace: test.namespace,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := client.ApiClient.Headers().Get("X-Vault-Namespace"); actual != test.expected {
+			t.Errorf("expected namespace '%s' with VAULT_NAMESPACE '%s' and namespace '%s', got '%s'", test.expected, test.env, test.namespace, actual)
+		}
+	}
+}
+
+// fakeVault serves the given handlers by path, e.g. "/v1/auth/jwt/login", and
+// counts the requests of every path.
+type fakeVault struct {
+	*httptest.Server
+	mutex    sync.Mutex
+	requests map[string]int
+}
+
+func newFakeVault(t *testing.T, handlers map[string]http.HandlerFunc) *fakeVault {
+	vault := &fakeVault{requests: map[string]int{}}
+	vault.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vault.mutex.Lock()
+		vault.requests[r.URL.Path]++
+		vault.mutex.Unlock()
+
+		handler, ok := handlers[r.URL.Path]
+		if !ok {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+		handler(w, r)
+	}))
+	return vault
+}
+
+func (vault *fakeVault) count(path string) int {
+	vault.mutex.Lock()
+	defer vault.mutex.Unlock()
+	return vault.requests[path]
+}
+
+func (vault *fakeVault) config() *Config {
+	return &Config{Config: &api.Config{Address: vault.URL, MaxRetries: -1}}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// authResponse is a login response with a token, valid for ttl seconds.
+func authResponse(token string, ttl int, renewable bool) map[string]interface{} {
+	return map[string]interface{}{
+		"auth": map[string]interface{}{
+			"client_token":   token,
+			"accessor":       "accessor-" + token,
+			"policies":       []string{"default"},
+			"metadata":       map[string]string{"role": "app"},
+			"lease_duration": ttl,
+			"renewable":      renewable,
+		},
+	}
+}
+
+// lookupResponse is a token lookup response, valid for ttl seconds.
+func lookupResponse(token string, ttl int, renewable bool) map[string]interface{} {
+	return map[string]interface{}{
+		"data": map[string]interface{}{
+			"id":        token,
+			"accessor":  "accessor-" + token,
+			"policies":  []string{"default"},
+			"meta":      map[string]string{"role": "app"},
+			"ttl":       ttl,
+			"renewable": renewable,
+		},
+	}
+}
+
+func writeTempFile(t *testing.T, dir string, name string, content string) string {
+	filename := path.Join(dir, name)
+	if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestReauthenticateNotRenewable(t *testing.T) {
+	defer func(backoff time.Duration) { reauthInitialBackoff = backoff }(reauthInitialBackoff)
+	reauthInitialBackoff = 10 * time.Millisecond
+
+	tmpDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var mutex sync.Mutex
+	logins := 0
+	vault := newFakeVault(t, map[string]http.HandlerFunc{
+		"/v1/auth/jwt/login": func(w http.ResponseWriter, r *http.Request) {
+			mutex.Lock()
+			logins++
+			login := logins
+			mutex.Unlock()
+
+			// Logging in again fails twice before it succeeds
+			if login == 2 || login == 3 {
+				http.Error(w, `{"errors":["unavailable"]}`, http.StatusServiceUnavailable)
+				return
+			}
+			writeJSON(w, authResponse(fmt.Sprintf("token-%d", login), 1, false))
+		},
+	})
+	defer vault.Close()
+
+	client, err := NewClient(hclog.NewNullLogger(), &AuthConfig{
+		Method:  AuthMethodJwt,
+		Role:    "app",
+		JwtFile: writeTempFile(t, tmpDir, "jwt", "header.payload.signature"),
+	}, vault.config())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	renewedCh := client.NotifyRenewed()
+	start := time.Now()
+	go client.StartAuthRenewal(ctx)
+
+	select {
+	case renewal := <-renewedCh:
+		if renewal.Name != AuthTokenName || renewal.Secret.Auth.ClientToken != "token-4" {
+			t.Errorf("expected new auth token token-4, got %s %v", renewal.Name, renewal.Secret.Auth)
+		}
+	case err := <-client.DoneCh():
+		t.Fatalf("expected to log in again, got %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("did not log in again")
+	}
+
+	// The token is used until shortly before it expires
+	if elapsed := time.Since(start); elapsed < 800*time.Millisecond {
+		t.Errorf("expected to log in again shortly before the token expires, logged in after %v", elapsed)
+	}
+	if client.ApiClient.Token() != "token-4" {
+		t.Errorf("expected client to use the new token, got %s", client.ApiClient.Token())
+	}
+	if count := vault.count("/v1/auth/jwt/login"); count != 4 {
+		t.Errorf("expected 4 logins, got %d", count)
+	}
+}
+
+func TestReauthenticateSameToken(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	vault := newFakeVault(t, map[string]http.HandlerFunc{
+		"/v1/auth/token/lookup-self": func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, lookupResponse(r.Header.Get("X-Vault-Token"), 1, false))
+		},
+	})
+	defer vault.Close()
+
+	client, err := NewClient(hclog.NewNullLogger(), &AuthConfig{
+		Method:    AuthMethodToken,
+		TokenFile: writeTempFile(t, tmpDir, "token", "operator-token\n"),
+	}, vault.config())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go client.StartAuthRenewal(ctx)
+
+	select {
+	case err := <-client.DoneCh():
+		if !errors.Is(err, ErrSameAuthToken) {
+			t.Errorf("expected %v, got %v", ErrSameAuthToken, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected to fail with the same token")
+	}
+
+	// Looked up at startup, and once when logging in again
+	if count := vault.count("/v1/auth/token/lookup-self"); count != 2 {
+		t.Errorf("expected the token to be looked up twice, got %d", count)
+	}
+}
+
+func TestStoredAuthExpiry(t *testing.T) {
+	// The stored auth secret has the lease duration of its last renewal
+	authSecret := &api.Secret{Auth: &api.SecretAuth{ClientToken: "token", LeaseDuration: 3600}}
+	expiry := time.Now().Add(time.Second)
+	client, err := NewClientFromSecret(hclog.NewNullLogger(), authSecret, &expiry, &Config{Config: &api.Config{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, actual, _ := client.auth(); !actual.Equal(expiry) {
+		t.Errorf("expected stored expiry %v, got %v", expiry, actual)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go client.StartAuthRenewal(ctx)
+
+	// The non-renewable token is used until shortly before the stored
+	// expiry, logging in again is not possible with a stored auth secret
+	select {
+	case err := <-client.DoneCh():
+		if !errors.Is(err, ErrCannotReauthenticate) {
+			t.Errorf("expected %v, got %v", ErrCannotReauthenticate, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected to wait for the stored expiry only")
+	}
+}
+
+func TestWrapAuthToken(t *testing.T) {
+	var mutex sync.Mutex
+	wrapped := map[string]string{}
+	vault := newFakeVault(t, map[string]http.HandlerFunc{
+		"/v1/auth/token/lookup-self": func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, lookupResponse(r.Header.Get("X-Vault-Token"), 3600, true))
+		},
+		"/v1/sys/wrapping/wrap": func(w http.ResponseWriter, r *http.Request) {
+			if ttl := r.Header.Get("X-Vault-Wrap-TTL"); ttl != "5m0s" {
+				t.Errorf("expected wrapping TTL 5m0s, got '%s'", ttl)
+			}
+			var data map[string]string
+			if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+				t.Error(err)
+			}
+			mutex.Lock()
+			wrapped["wrapping-token"] = data["token"]
+			mutex.Unlock()
+			writeJSON(w, map[string]interface{}{
+				"wrap_info": map[string]interface{}{
+					"token":         "wrapping-token",
+					"ttl":           300,
+					"creation_time": time.Now(),
+					"creation_path": "sys/wrapping/wrap",
+				},
+			})
+		},
+		"/v1/sys/wrapping/lookup": func(w http.ResponseWriter, r *http.Request) {
+			var data map[string]string
+			if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+				t.Error(err)
+			}
+			creationPath := "sys/wrapping/wrap"
+			if data["token"] == "tampered-token" {
+				creationPath = "auth/token/create"
+			}
+			writeJSON(w, map[string]interface{}{
+				"data": map[string]interface{}{"creation_path": creationPath},
+			})
+		},
+		// A wrapping token can be unwrapped only once
+		"/v1/sys/wrapping/unwrap": func(w http.ResponseWriter, r *http.Request) {
+			wrappingToken := r.Header.Get("X-Vault-Token")
+			mutex.Lock()
+			token, ok := wrapped[wrappingToken]
+			delete(wrapped, wrappingToken)
+			mutex.Unlock()
+			if !ok {
+				http.Error(w, `{"errors":["wrapping token is not valid or does not exist"]}`, http.StatusBadRequest)
+				return
+			}
+			writeJSON(w, map[string]interface{}{
+				"data": map[string]interface{}{"token": token},
+			})
+		},
+	})
+	defer vault.Close()
+
+	client, err := NewClientFromSecret(hclog.NewNullLogger(), &api.Secret{
+		Auth: &api.SecretAuth{ClientToken: "auth-token"},
+	}, nil, vault.config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrappedSecret, err := client.WrapAuthToken(5 * time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wrappedSecret.Auth != nil || wrappedSecret.WrapInfo == nil || wrappedSecret.WrapInfo.Token != "wrapping-token" {
+		t.Fatalf("expected secret with only the wrapping token, got %+v", wrappedSecret)
+	}
+
+	unwrappedClient, err := NewClientFromSecret(hclog.NewNullLogger(), wrappedSecret, nil, vault.config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unwrappedClient.ApiClient.Token() != "auth-token" || unwrappedClient.AuthSecret().Auth.LeaseDuration != 3600 {
+		t.Errorf("expected client with the unwrapped auth token, got %+v", unwrappedClient.AuthSecret().Auth)
+	}
+
+	// The wrapping token was used already
+	if _, err := NewClientFromSecret(hclog.NewNullLogger(), wrappedSecret, nil, vault.config()); !errors.Is(err, ErrUnwrapFailed) {
+		t.Errorf("expected %v unwrapping twice, got %v", ErrUnwrapFailed, err)
+	}
+
+	// The wrapping token was not created by sys/wrapping/wrap
+	tampered := &api.Secret{WrapInfo: &api.SecretWrapInfo{Token: "tampered-token"}}
+	if _, err := NewClientFromSecret(hclog.NewNullLogger(), tampered, nil, vault.config()); !errors.Is(err, ErrUnwrapFailed) {
+		t.Errorf("expected %v for a tampered wrapping token, got %v", ErrUnwrapFailed, err)
+	}
+	if count := vault.count("/v1/sys/wrapping/unwrap"); count != 2 {
+		t.Errorf("expected the tampered wrapping token not to be unwrapped, got %d unwraps", count)
+	}
+}
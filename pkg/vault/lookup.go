@@ -0,0 +1,121 @@
+package vault
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/hashicorp/vault/helper/parseutil"
+)
+
+// AuthTokenName is the name of the auth token in lease lookups.
+const AuthTokenName = "auth token"
+
+// LeaseStatus is the state of a secret lease, or of the auth token, as
+// looked up in vault.
+type LeaseStatus struct {
+	Name    string
+	LeaseID string
+	// Remaining time to live, 0 if expired
+	TTL     time.Duration
+	Expired bool
+}
+
+func (s LeaseStatus) String() string {
+	if s.Expired {
+		return fmt.Sprintf("%s: expired", s.Name)
+	}
+	return fmt.Sprintf("%s: expires in %v", s.Name, s.TTL)
+}
+
+// LookupLeases looks up the auth token and the leases of all given secrets,
+// and returns the ones that expired, or expire within threshold. Leases
+// are not looked up once the auth token expired, as vault denies all
+// requests with it.
+func (v *Client) LookupLeases(secretMap map[string]api.Secret, threshold time.Duration) ([]LeaseStatus, error) {
+	var statuses []LeaseStatus
+
+	v.logger.Debug("looking up auth token")
+	self, err := v.ApiClient.Auth().Token().LookupSelf()
+	token, err := tokenStatus(self, err)
+	if err != nil {
+		return nil, err
+	}
+	if token.Expired {
+		return []LeaseStatus{token}, nil
+	}
+	if token.TTL < threshold {
+		statuses = append(statuses, token)
+	}
+
+	names := make([]string, 0, len(secretMap))
+	for name, secret := range secretMap {
+		if secret.LeaseID != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		leaseID := secretMap[name].LeaseID
+		v.logger.Debug("looking up secret lease", "name", name)
+		lease, err := v.ApiClient.Logical().Write("sys/leases/lookup", map[string]interface{}{
+			"lease_id": leaseID,
+		})
+		status, err := leaseStatus(name, leaseID, lease, err)
+		if err != nil {
+			return nil, err
+		}
+		if status.Expired || status.TTL < threshold {
+			statuses = append(statuses, status)
+		}
+	}
+	return statuses, nil
+}
+
+// tokenStatus returns the status of the auth token from a token lookup.
+func tokenStatus(self *api.Secret, err error) (LeaseStatus, error) {
+	status := LeaseStatus{Name: AuthTokenName}
+	if err != nil {
+		if strings.Contains(err.Error(), "permission denied") {
+			status.Expired = true
+			return status, nil
+		}
+		return status, fmt.Errorf("failed to look up auth token: %v", err)
+	}
+	if self == nil {
+		return status, fmt.Errorf("error looking up token, %v", ErrRenewerNoSecretData)
+	}
+
+	ttl, err := self.TokenTTL()
+	if err != nil {
+		return status, err
+	}
+	status.TTL = ttl
+	return status, nil
+}
+
+// leaseStatus returns the status of a secret lease from a lease lookup.
+func leaseStatus(name, leaseID string, lease *api.Secret, err error) (LeaseStatus, error) {
+	status := LeaseStatus{Name: name, LeaseID: leaseID}
+	if err != nil {
+		if strings.Contains(err.Error(), "invalid lease") {
+			status.Expired = true
+			return status, nil
+		}
+		return status, fmt.Errorf("failed to look up lease of secret %s: %v", name, err)
+	}
+	if lease == nil {
+		return status, fmt.Errorf("error looking up lease of secret %s, %v", name, ErrRenewerNoSecretData)
+	}
+
+	ttl, err := parseutil.ParseDurationSecond(lease.Data["ttl"])
+	if err != nil {
+		return status, err
+	}
+	status.TTL = ttl
+	status.Expired = ttl <= 0
+	return status, nil
+}
@@ -0,0 +1,62 @@
+package vault
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+func TestLeaseStatus(t *testing.T) {
+	tests := []struct {
+		name    string
+		lease   *api.Secret
+		err     error
+		ttl     time.Duration
+		expired bool
+		fails   bool
+	}{
+		{"valid", &api.Secret{Data: map[string]interface{}{"ttl": json.Number("3600")}}, nil, time.Hour, false, false},
+		{"zero ttl", &api.Secret{Data: map[string]interface{}{"ttl": json.Number("0")}}, nil, 0, true, false},
+		{"invalid lease", nil, errors.New("Error making API request.\n\nCode: 400. Errors:\n\n* invalid lease"), 0, true, false},
+		{"vault down", nil, errors.New("connection refused"), 0, false, true},
+		{"no data", nil, nil, 0, false, true},
+	}
+
+	for _, test := range tests {
+		status, err := leaseStatus(test.name, "lease-id", test.lease, test.err)
+		if test.fails {
+			if err == nil {
+				t.Errorf("[%s] expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("[%s] unexpected error %v", test.name, err)
+			continue
+		}
+		if status.TTL != test.ttl || status.Expired != test.expired {
+			t.Errorf("[%s] expected ttl %v and expired %v, got %v", test.name, test.ttl, test.expired, status)
+		}
+	}
+}
+
+func TestTokenStatus(t *testing.T) {
+	status, err := tokenStatus(nil, errors.New("Error making API request.\n\nCode: 403. Errors:\n\n* permission denied"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.Expired {
+		t.Errorf("expected auth token to be expired, got %v", status)
+	}
+
+	status, err = tokenStatus(&api.Secret{Data: map[string]interface{}{"ttl": json.Number("60")}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Expired || status.TTL != time.Minute {
+		t.Errorf("expected auth token to expire in 1m, got %v", status)
+	}
+}